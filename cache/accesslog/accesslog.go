@@ -0,0 +1,210 @@
+package accesslog
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/fkautz/tigerbat/cache/logger"
+	"golang.org/x/net/context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Formats of the access log.
+const (
+	FormatJSON     = "json"
+	FormatCombined = "combined"
+	FormatOff      = "off"
+)
+
+// RequestIDHeader carries the request ID to peers and the upstream, and back
+// to the client.
+const RequestIDHeader = "X-Request-Id"
+
+// Entry is a line of the access log.
+type Entry struct {
+	Time          time.Time `json:"time"`
+	Listener      string    `json:"listener"`
+	RequestID     string    `json:"request_id"`
+	RemoteAddr    string    `json:"remote_addr"`
+	Method        string    `json:"method"`
+	URI           string    `json:"uri"`
+	Proto         string    `json:"proto"`
+	Status        int       `json:"status"`
+	Cache         string    `json:"cache,omitempty"`
+	Tier          string    `json:"tier,omitempty"`
+	Bytes         int64     `json:"bytes"`
+	UpstreamBytes int64     `json:"upstream_bytes"`
+	DurationMs    float64   `json:"duration_ms"`
+	Referer       string    `json:"referer,omitempty"`
+	UserAgent     string    `json:"user_agent,omitempty"`
+}
+
+type entryContextKey struct{}
+
+// FromRequest returns the entry logged for r, nil if r isn't logged.
+// Handlers fill in what only they know, like the upstream bytes.
+func FromRequest(r *http.Request) *Entry {
+	entry, _ := r.Context().Value(entryContextKey{}).(*Entry)
+	return entry
+}
+
+// NewHandler logs the requests next serves to out. Requests without an ID
+// get one, it is set on the request so it is passed on upstream.
+func NewHandler(next http.Handler, out io.Writer, format, listener string) http.Handler {
+	if format == FormatOff || format == "" {
+		return next
+	}
+	return &handler{
+		next:     next,
+		out:      out,
+		format:   format,
+		listener: listener,
+	}
+}
+
+type handler struct {
+	next     http.Handler
+	out      io.Writer
+	outLock  sync.Mutex
+	format   string
+	listener string
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := r.Header.Get(RequestIDHeader)
+	if requestID == "" || len(requestID) > 128 {
+		requestID = newRequestID()
+		r.Header.Set(RequestIDHeader, requestID)
+	}
+	w.Header().Set(RequestIDHeader, requestID)
+
+	entry := &Entry{
+		Time:       time.Now(),
+		Listener:   h.listener,
+		RequestID:  requestID,
+		RemoteAddr: r.RemoteAddr,
+		Method:     r.Method,
+		URI:        r.RequestURI,
+		Proto:      r.Proto,
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+	}
+	ctx := context.WithValue(r.Context(), entryContextKey{}, entry)
+	lw := &loggingWriter{ResponseWriter: w, entry: entry}
+	h.next.ServeHTTP(lw, r.WithContext(ctx))
+
+	if entry.Status == 0 {
+		entry.Status = http.StatusOK
+	}
+	if entry.Cache == "" {
+		entry.Cache = w.Header().Get("X-Cache")
+	}
+	if entry.Tier == "" {
+		entry.Tier = w.Header().Get("X-Cache-Tier")
+	}
+	entry.DurationMs = float64(time.Since(entry.Time)) / float64(time.Millisecond)
+	h.write(entry)
+}
+
+func (h *handler) write(entry *Entry) {
+	var line []byte
+	switch h.format {
+	case FormatCombined:
+		line = []byte(combined(entry))
+	default:
+		js, err := json.Marshal(entry)
+		if err != nil {
+			logger.Errorln("Unable to log request", err)
+			return
+		}
+		line = append(js, '\n')
+	}
+	h.outLock.Lock()
+	defer h.outLock.Unlock()
+	if _, err := h.out.Write(line); err != nil {
+		logger.Errorln("Unable to log request", err)
+	}
+}
+
+// combined formats entry in the combined log format, followed by the fields
+// the format has no room for.
+func combined(entry *Entry) string {
+	host := entry.RemoteAddr
+	if i := lastColon(host); i >= 0 {
+		host = host[:i]
+	}
+	return fmt.Sprintf("%s - - [%s] %q %d %d %q %q id=%s cache=%s tier=%q upstream_bytes=%d duration_ms=%.3f\n",
+		host,
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		entry.Method+" "+entry.URI+" "+entry.Proto,
+		entry.Status,
+		entry.Bytes,
+		entry.Referer,
+		entry.UserAgent,
+		entry.RequestID,
+		dash(entry.Cache),
+		entry.Tier,
+		entry.UpstreamBytes,
+		entry.DurationMs)
+}
+
+func lastColon(s string) int {
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] == ':' {
+			return i
+		}
+		if s[i] == ']' {
+			break
+		}
+	}
+	return -1
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(id)
+}
+
+// loggingWriter records the status and the number of bytes written.
+type loggingWriter struct {
+	http.ResponseWriter
+	entry *Entry
+}
+
+func (w *loggingWriter) WriteHeader(code int) {
+	if w.entry.Status == 0 {
+		w.entry.Status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *loggingWriter) Write(p []byte) (int, error) {
+	if w.entry.Status == 0 {
+		w.entry.Status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.entry.Bytes += int64(n)
+	return n, err
+}
+
+// Flush lets the pass-through proxy stream through the log.
+func (w *loggingWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
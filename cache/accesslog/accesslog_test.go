@@ -0,0 +1,51 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandlerLogsJSON(t *testing.T) {
+	var out bytes.Buffer
+	handler := NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "abc", r.Header.Get(RequestIDHeader))
+		FromRequest(r).UpstreamBytes = 3
+		w.Header().Set("X-Cache", "MISS")
+		w.Write([]byte("hello"))
+	}), &out, FormatJSON, "client")
+
+	r := httptest.NewRequest("GET", "/foo", nil)
+	r.Header.Set(RequestIDHeader, "abc")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, "abc", w.Header().Get(RequestIDHeader))
+
+	var entry Entry
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &entry))
+	assert.Equal(t, "abc", entry.RequestID)
+	assert.Equal(t, "client", entry.Listener)
+	assert.Equal(t, http.StatusOK, entry.Status)
+	assert.Equal(t, "MISS", entry.Cache)
+	assert.Equal(t, int64(5), entry.Bytes)
+	assert.Equal(t, int64(3), entry.UpstreamBytes)
+}
+
+func TestHandlerGeneratesRequestID(t *testing.T) {
+	var out bytes.Buffer
+	var seen string
+	handler := NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get(RequestIDHeader)
+		w.WriteHeader(http.StatusNotFound)
+	}), &out, FormatCombined, "peer")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/foo", nil))
+	assert.NotEqual(t, "", seen)
+	assert.Equal(t, seen, w.Header().Get(RequestIDHeader))
+	assert.Contains(t, out.String(), `"GET /foo HTTP/1.1" 404 0`)
+	assert.Contains(t, out.String(), "id="+seen)
+}
@@ -3,21 +3,29 @@ package diskcache
 import (
 	"container/heap"
 	"errors"
+	"github.com/boltdb/bolt"
+	"github.com/fkautz/tigerbat/cache/logger"
+	"golang.org/x/net/context"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/boltdb/bolt"
 )
 
 type Cache interface {
-	Get(key string) (io.ReadCloser, error)
-	GetRange(key string, offset, length int64) (io.ReadCloser, error)
+	// Get, GetRange and Put stop reading and writing once ctx is done. An
+	// interrupted Put leaves nothing behind.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
 	Hit(key string) error
-	Put(key string, writer io.Reader) error
+	Put(ctx context.Context, key string, writer io.Reader) error
+	// Check reports why the cache can't take new blocks, if it can't.
+	Check() error
 	Shutdown() error
 }
 
@@ -32,19 +40,19 @@ func New(root string, maxSize int64, cleanedSize int64) (Cache, error) {
 		maxSize:     maxSize,
 		cleanedSize: cleanedSize,
 		root:        root,
-		size:        int64(0),
 		dblock:      new(sync.RWMutex),
 		fslock:      new(sync.RWMutex),
+		hits:        make(map[string]time.Time),
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{}),
 	}
+	diskMaxUsage.Set(float64(maxSize))
+	diskCleanedUsage.Set(float64(cleanedSize))
 	dc.fixSize()
-	log.Println("Disk Cache Size:", dc.size)
-	log.Println("Cleaning keys...")
 	dc.clean()
-	log.Println("Disk Cache Size:", dc.size)
-	log.Println(dc.cleanedSize)
-	log.Println("Disk Cache Size:", dc.size)
-	log.Println(dc.maxSize)
-	log.Println("Disk Cache Size:", dc.size)
+	logger.Infoln("Disk cache size:", atomic.LoadInt64(&dc.size), "max:", dc.maxSize, "cleaned:", dc.cleanedSize)
+	diskUsage.Set(float64(atomic.LoadInt64(&dc.size)))
+	go dc.flushHitsEvery(hitFlushInterval)
 	return dc, nil
 }
 
@@ -52,31 +60,49 @@ type diskCache struct {
 	cleanedSize int64
 	maxSize     int64
 	root        string
-	size        int64
+	// changed under fslock, Check reads it without, so it is only accessed
+	// atomically
+	size int64
 
 	db     *bolt.DB
 	dblock *sync.RWMutex
 	fslock *sync.RWMutex
+
+	// hit timestamps not yet written to bolt
+	hits     map[string]time.Time
+	hitsLock sync.Mutex
+
+	stop     chan struct{}
+	stopped  chan struct{}
+	shutdown sync.Once
 }
 
+// hitFlushInterval is how often hit timestamps are written to bolt.
+const hitFlushInterval = 10 * time.Second
+
 type entry struct {
 	key     string
 	lastHit time.Time
 }
 
-func (dc *diskCache) Get(key string) (io.ReadCloser, error) {
+func (dc *diskCache) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	dc.Hit(key)
 	dc.fslock.RLock()
 	fi, err := os.Stat(path.Join(dc.root, key))
 	dc.fslock.RUnlock()
 	if err != nil {
+		diskLookups.WithLabelValues("miss").Inc()
 		return nil, err
 	}
+	diskLookups.WithLabelValues("hit").Inc()
 	// HIT, return full range
-	return dc.GetRange(key, 0, fi.Size())
+	return dc.GetRange(ctx, key, 0, fi.Size())
 }
 
-func (dc *diskCache) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+func (dc *diskCache) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
 	dc.Hit(key)
 	key = path.Join(dc.root, key)
 	dc.fslock.RLock()
@@ -96,7 +122,7 @@ func (dc *diskCache) GetRange(key string, offset, length int64) (io.ReadCloser,
 		}
 		defer file.Close()
 		file.Seek(offset, 0)
-		_, err = io.CopyN(writer, file, length)
+		_, err = io.CopyN(writer, contextReader{ctx: ctx, reader: file}, length)
 		if err != nil {
 			writer.CloseWithError(err)
 		} else {
@@ -106,7 +132,7 @@ func (dc *diskCache) GetRange(key string, offset, length int64) (io.ReadCloser,
 	return reader, nil
 }
 
-func (dc *diskCache) Put(key string, reader io.Reader) error {
+func (dc *diskCache) Put(ctx context.Context, key string, reader io.Reader) error {
 	dc.fslock.Lock()
 	defer dc.fslock.Unlock()
 	key = path.Join(dc.root, key)
@@ -114,29 +140,102 @@ func (dc *diskCache) Put(key string, reader io.Reader) error {
 	if err != nil {
 		return err
 	}
-	n, err := io.Copy(file, reader)
+	n, err := io.Copy(file, contextReader{ctx: ctx, reader: reader})
 	if err != nil {
 		file.Close()
 		os.RemoveAll(key)
 		return err
 	}
-	dc.size = dc.size + n
+	atomic.AddInt64(&dc.size, n)
 	dc.dblock.Lock()
 	dc.db.Update(updateKeyTimestamp(key))
 	dc.dblock.Unlock()
 	dc.clean()
+	diskUsage.Set(float64(atomic.LoadInt64(&dc.size)))
 	return nil
 }
 
+// contextReader fails reads once ctx is done.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+// Hit records that key was used. Timestamps are written to bolt in batches,
+// see flushHits.
 func (dc *diskCache) Hit(key string) error {
+	dc.hitsLock.Lock()
+	dc.hits[key] = time.Now()
+	dc.hitsLock.Unlock()
+	return nil
+}
+
+func (dc *diskCache) flushHits() error {
+	dc.hitsLock.Lock()
+	hits := dc.hits
+	dc.hits = make(map[string]time.Time)
+	dc.hitsLock.Unlock()
+	if len(hits) == 0 {
+		return nil
+	}
 	dc.dblock.Lock()
 	defer dc.dblock.Unlock()
-	dc.db.Update(updateKeyTimestamp(key))
+	return dc.db.Update(updateKeyTimestamps(hits))
+}
+
+func (dc *diskCache) flushHitsEvery(interval time.Duration) {
+	defer close(dc.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := dc.flushHits(); err != nil {
+				logger.Warnln("Unable to write hits", err)
+			}
+		case <-dc.stop:
+			return
+		}
+	}
+}
+
+func (dc *diskCache) Check() error {
+	file, err := ioutil.TempFile(dc.root, ".check")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	os.Remove(file.Name())
+	if size := atomic.LoadInt64(&dc.size); size > dc.maxSize {
+		return errors.New("Disk cache size " + strconv.FormatInt(size, 10) + " over max-disk-usage " + strconv.FormatInt(dc.maxSize, 10))
+	}
 	return nil
 }
 
+// Shutdown writes the pending hit timestamps and closes bolt. The cache
+// can't be used afterwards, later calls do nothing.
 func (dc *diskCache) Shutdown() error {
-	return errors.New("Not Implemented")
+	var err error
+	dc.shutdown.Do(func() {
+		close(dc.stop)
+		<-dc.stopped
+		err = dc.flushHits()
+		dc.fslock.Lock()
+		defer dc.fslock.Unlock()
+		dc.dblock.Lock()
+		defer dc.dblock.Unlock()
+		if closeErr := dc.db.Close(); err == nil {
+			err = closeErr
+		}
+	})
+	return err
 }
 
 type entryHeap []entry
@@ -185,11 +284,18 @@ func (dc *diskCache) fixSize() {
 			dc.db.Update(remove(key.key))
 		}
 	}
-	log.Println("totalSize", totalSize)
-	dc.size = totalSize
+	logger.Debugln("Disk cache size on disk:", totalSize)
+	atomic.StoreInt64(&dc.size, totalSize)
+	diskUsage.Set(float64(totalSize))
 }
 
 func (dc *diskCache) clean() {
+	// evict by the latest hits
+	if atomic.LoadInt64(&dc.size) > dc.maxSize {
+		if err := dc.flushHits(); err != nil {
+			logger.Warnln("Unable to write hits", err)
+		}
+	}
 	keys := &entryHeap{}
 	heap.Init(keys)
 	dc.db.View(func(tx *bolt.Tx) error {
@@ -212,8 +318,8 @@ func (dc *diskCache) clean() {
 		return nil
 	})
 
-	for dc.size > dc.cleanedSize {
-		log.Println("cleaning: ", dc.size, ">", dc.cleanedSize)
+	for size := atomic.LoadInt64(&dc.size); size > dc.cleanedSize; size = atomic.LoadInt64(&dc.size) {
+		logger.Debugln("Cleaning:", size, ">", dc.cleanedSize)
 		key := heap.Pop(keys).(entry)
 		dc.remove(key.key)
 	}
@@ -227,7 +333,9 @@ func (dc *diskCache) remove(key string) {
 	}
 	os.Remove(file)
 	dc.db.Update(remove(key))
-	dc.size = dc.size - info.Size()
+	atomic.AddInt64(&dc.size, -info.Size())
+	diskEvictions.Inc()
+	diskEvictedBytes.Add(float64(info.Size()))
 }
 
 func updateKeyTimestamp(key string) func(tx *bolt.Tx) error {
@@ -245,6 +353,25 @@ func updateKeyTimestamp(key string) func(tx *bolt.Tx) error {
 	}
 }
 
+func updateKeyTimestamps(hits map[string]time.Time) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("key-timestamps"))
+		if err != nil {
+			return err
+		}
+		for key, hit := range hits {
+			binaryHit, err := hit.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(key), binaryHit); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
 func remove(key string) func(tx *bolt.Tx) error {
 	return func(tx *bolt.Tx) error {
 		bucket, err := tx.CreateBucketIfNotExists([]byte("key-timestamps"))
@@ -0,0 +1,64 @@
+package diskcache
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestShutdownTwice(t *testing.T) {
+	root, err := ioutil.TempDir("", "diskcache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+	dc, err := New(root, 1024, 512)
+	assert.Nil(t, err)
+
+	assert.Nil(t, dc.Shutdown())
+	assert.Nil(t, dc.Shutdown())
+}
+
+func TestCheckWhilePutting(t *testing.T) {
+	root, err := ioutil.TempDir("", "diskcache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+	dc, err := New(root, 1<<20, 1<<19)
+	assert.Nil(t, err)
+	defer dc.Shutdown()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			dc.Put(context.Background(), strconv.Itoa(i), bytes.NewReader(make([]byte, 64)))
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			assert.Nil(t, dc.Check())
+			return
+		default:
+			dc.Check()
+		}
+	}
+}
+
+func TestPutFlushesHitsOnlyOverMax(t *testing.T) {
+	root, err := ioutil.TempDir("", "diskcache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+	cache, err := New(root, 1<<20, 1<<19)
+	assert.Nil(t, err)
+	defer cache.Shutdown()
+	dc := cache.(*diskCache)
+
+	dc.Hit("a")
+	assert.Nil(t, dc.Put(context.Background(), "a", bytes.NewReader(make([]byte, 64))))
+	dc.hitsLock.Lock()
+	assert.Len(t, dc.hits, 1)
+	dc.hitsLock.Unlock()
+}
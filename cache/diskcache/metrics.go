@@ -0,0 +1,46 @@
+package diskcache
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	diskLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tigerbat",
+		Subsystem: "disk",
+		Name:      "lookups_total",
+		Help:      "Disk cache lookups by result: hit or miss.",
+	}, []string{"result"})
+	diskEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tigerbat",
+		Subsystem: "disk",
+		Name:      "evictions_total",
+		Help:      "Blocks removed from disk to make room.",
+	})
+	diskEvictedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tigerbat",
+		Subsystem: "disk",
+		Name:      "evicted_bytes_total",
+		Help:      "Bytes removed from disk to make room.",
+	})
+	diskUsage = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "tigerbat",
+		Subsystem: "disk",
+		Name:      "usage_bytes",
+		Help:      "Bytes held on disk.",
+	})
+	diskMaxUsage = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "tigerbat",
+		Subsystem: "disk",
+		Name:      "max_usage_bytes",
+		Help:      "Disk usage that triggers cleaning, see max-disk-usage.",
+	})
+	diskCleanedUsage = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "tigerbat",
+		Subsystem: "disk",
+		Name:      "cleaned_usage_bytes",
+		Help:      "Disk usage cleaning brings the cache down to, see cleaned-disk-usage.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(diskLookups, diskEvictions, diskEvictedBytes, diskUsage, diskMaxUsage, diskCleanedUsage)
+}
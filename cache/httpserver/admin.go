@@ -0,0 +1,96 @@
+package httpserver
+
+import (
+	"crypto/subtle"
+	"github.com/fkautz/tigerbat/cache/hydrator"
+	"github.com/fkautz/tigerbat/cache/logger"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+// NewAdminHandler serves the admin API. It is meant for its own listener,
+// every request must carry token as a bearer token.
+//
+//	POST /purge/url/{url}       purge a url
+//	POST /purge/prefix/{prefix} purge every url starting with prefix
+//	POST /purge/tag/{tag}       purge every url whose object carries tag
+//	POST /purge/all             purge everything
+//	GET  /log/level             the log level
+//	POST /log/level/{level}     change the log level
+func NewAdminHandler(cache hydrator.Cache, token string) http.Handler {
+	admin := &adminHandler{
+		cache: cache,
+		token: token,
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/purge/url/{url:.+}", admin.purge).Methods("POST")
+	router.HandleFunc("/purge/prefix/{prefix:.*}", admin.purgePrefix).Methods("POST")
+	router.HandleFunc("/purge/tag/{tag}", admin.purgeTag).Methods("POST")
+	router.HandleFunc("/purge/all", admin.purgeAll).Methods("POST")
+	router.HandleFunc("/log/level", admin.logLevel).Methods("GET")
+	router.HandleFunc("/log/level/{level}", admin.setLogLevel).Methods("POST")
+	admin.router = router
+	return admin
+}
+
+type adminHandler struct {
+	cache  hydrator.Cache
+	token  string
+	router *mux.Router
+}
+
+func (a *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+a.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="tigerbat"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	a.router.ServeHTTP(w, r)
+}
+
+func (a *adminHandler) purge(w http.ResponseWriter, r *http.Request) {
+	url := mux.Vars(r)["url"]
+	logger.Infoln("Purging", url)
+	a.respond(w, a.cache.Purge(url))
+}
+
+func (a *adminHandler) purgePrefix(w http.ResponseWriter, r *http.Request) {
+	prefix := mux.Vars(r)["prefix"]
+	logger.Infoln("Purging prefix", prefix)
+	a.respond(w, a.cache.PurgePrefix(prefix))
+}
+
+func (a *adminHandler) purgeTag(w http.ResponseWriter, r *http.Request) {
+	tag := mux.Vars(r)["tag"]
+	logger.Infoln("Purging tag", tag)
+	a.respond(w, a.cache.PurgeTag(tag))
+}
+
+func (a *adminHandler) purgeAll(w http.ResponseWriter, r *http.Request) {
+	logger.Infoln("Purging everything")
+	a.respond(w, a.cache.PurgeAll())
+}
+
+func (a *adminHandler) logLevel(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(logger.GetLevel().String() + "\n"))
+}
+
+func (a *adminHandler) setLogLevel(w http.ResponseWriter, r *http.Request) {
+	level, err := logger.ParseLevel(mux.Vars(r)["level"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logger.Infoln("Setting log level to", level)
+	logger.SetLevel(level)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminHandler) respond(w http.ResponseWriter, err error) {
+	if err != nil {
+		logger.Errorln("Purge failed", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,109 @@
+package httpserver
+
+import (
+	"github.com/fkautz/tigerbat/cache/hydrator"
+	"github.com/fkautz/tigerbat/cache/logger"
+	"github.com/fkautz/tigerbat/cache/sizereaderat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"golang.org/x/net/context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type testCache struct {
+	mock.Mock
+}
+
+func (m *testCache) Get(ctx context.Context, url string, cacheEntry *hydrator.CacheEntry, provenance *hydrator.Provenance) (sizereaderat.SizeReaderAt, error) {
+	args := m.Called(url, cacheEntry, provenance)
+	return args.Get(0).(sizereaderat.SizeReaderAt), args.Error(1)
+}
+
+func (m *testCache) GetMetadata(ctx context.Context, url string, clientHeaders http.Header) (*hydrator.CacheEntry, error) {
+	args := m.Called(url, clientHeaders)
+	return args.Get(0).(*hydrator.CacheEntry), args.Error(1)
+}
+
+func (m *testCache) Stream(ctx context.Context, url string, cacheEntry *hydrator.CacheEntry, provenance *hydrator.Provenance) (io.Reader, error) {
+	args := m.Called(url, cacheEntry, provenance)
+	return args.Get(0).(io.Reader), args.Error(1)
+}
+
+func (m *testCache) Invalidate(url string) error {
+	return m.Called(url).Error(0)
+}
+
+func (m *testCache) Purge(url string) error {
+	return m.Called(url).Error(0)
+}
+
+func (m *testCache) PurgePrefix(prefix string) error {
+	return m.Called(prefix).Error(0)
+}
+
+func (m *testCache) PurgeAll() error {
+	return m.Called().Error(0)
+}
+
+func (m *testCache) PurgeTag(tag string) error {
+	return m.Called(tag).Error(0)
+}
+
+func (m *testCache) Status() *hydrator.Status {
+	return m.Called().Get(0).(*hydrator.Status)
+}
+
+func (m *testCache) Leave() error {
+	return m.Called().Error(0)
+}
+
+func (m *testCache) Shutdown() error {
+	return m.Called().Error(0)
+}
+
+func adminRequest(handler http.Handler, path, token string) int {
+	r := httptest.NewRequest("POST", path, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestAdminPurge(t *testing.T) {
+	cache := new(testCache)
+	cache.On("Purge", "foo/bar.iso").Return(nil)
+	cache.On("PurgePrefix", "foo/").Return(nil)
+	cache.On("PurgeAll").Return(nil)
+	cache.On("PurgeTag", "release-1.4").Return(nil)
+	handler := NewAdminHandler(cache, "secret")
+
+	assert.Equal(t, http.StatusNoContent, adminRequest(handler, "/purge/url/foo/bar.iso", "secret"))
+	assert.Equal(t, http.StatusNoContent, adminRequest(handler, "/purge/prefix/foo/", "secret"))
+	assert.Equal(t, http.StatusNoContent, adminRequest(handler, "/purge/all", "secret"))
+	assert.Equal(t, http.StatusNoContent, adminRequest(handler, "/purge/tag/release-1.4", "secret"))
+	cache.AssertExpectations(t)
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	cache := new(testCache)
+	handler := NewAdminHandler(cache, "secret")
+
+	assert.Equal(t, http.StatusUnauthorized, adminRequest(handler, "/purge/all", ""))
+	assert.Equal(t, http.StatusUnauthorized, adminRequest(handler, "/purge/all", "wrong"))
+	cache.AssertNotCalled(t, "PurgeAll")
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	defer logger.SetLevel(logger.GetLevel())
+	handler := NewAdminHandler(new(testCache), "secret")
+
+	assert.Equal(t, http.StatusNoContent, adminRequest(handler, "/log/level/debug", "secret"))
+	assert.Equal(t, logger.Debug, logger.GetLevel())
+	assert.Equal(t, http.StatusBadRequest, adminRequest(handler, "/log/level/verbose", "secret"))
+	assert.Equal(t, logger.Debug, logger.GetLevel())
+}
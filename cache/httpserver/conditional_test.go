@@ -0,0 +1,94 @@
+package httpserver
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testModtime = time.Date(2016, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+func newConditionalRequest(method string, headers map[string]string) *http.Request {
+	r := httptest.NewRequest(method, "/foo", nil)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	return r
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Length", "10")
+	r := newConditionalRequest("GET", map[string]string{"If-None-Match": `"bar", "foo"`})
+	done, _ := checkPreconditions(w, r, `"foo"`, testModtime)
+	assert.True(t, done)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Equal(t, "", w.Header().Get("Content-Length"))
+
+	w = httptest.NewRecorder()
+	r = newConditionalRequest("GET", map[string]string{"If-None-Match": `"bar"`})
+	done, _ = checkPreconditions(w, r, `"foo"`, testModtime)
+	assert.False(t, done)
+}
+
+func TestIfModifiedSince(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := newConditionalRequest("HEAD", map[string]string{"If-Modified-Since": testModtime.Format(http.TimeFormat)})
+	done, _ := checkPreconditions(w, r, "", testModtime)
+	assert.True(t, done)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	w = httptest.NewRecorder()
+	r = newConditionalRequest("GET", map[string]string{"If-Modified-Since": testModtime.Add(-time.Hour).Format(http.TimeFormat)})
+	done, _ = checkPreconditions(w, r, "", testModtime)
+	assert.False(t, done)
+
+	// If-None-Match takes precedence
+	w = httptest.NewRecorder()
+	r = newConditionalRequest("GET", map[string]string{
+		"If-None-Match":     `"bar"`,
+		"If-Modified-Since": testModtime.Format(http.TimeFormat),
+	})
+	done, _ = checkPreconditions(w, r, `"foo"`, testModtime)
+	assert.False(t, done)
+}
+
+func TestIfMatch(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := newConditionalRequest("GET", map[string]string{"If-Match": `"bar"`})
+	done, _ := checkPreconditions(w, r, `"foo"`, testModtime)
+	assert.True(t, done)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+	w = httptest.NewRecorder()
+	r = newConditionalRequest("GET", map[string]string{"If-Unmodified-Since": testModtime.Add(-time.Hour).Format(http.TimeFormat)})
+	done, _ = checkPreconditions(w, r, "", testModtime)
+	assert.True(t, done)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+}
+
+func TestIfRange(t *testing.T) {
+	tests := []struct {
+		ifRange string
+		etag    string
+		want    string
+	}{
+		{`"foo"`, `"foo"`, "bytes=0-1"},
+		{`"bar"`, `"foo"`, ""},
+		{`W/"foo"`, `W/"foo"`, ""},
+		{testModtime.Format(http.TimeFormat), "", "bytes=0-1"},
+		{testModtime.Add(time.Hour).Format(http.TimeFormat), "", ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := newConditionalRequest("GET", map[string]string{
+			"Range":    "bytes=0-1",
+			"If-Range": test.ifRange,
+		})
+		done, rangeHeader := checkPreconditions(w, r, test.etag, testModtime)
+		assert.False(t, done)
+		assert.Equal(t, test.want, rangeHeader, test.ifRange)
+	}
+}
@@ -0,0 +1,20 @@
+package httpserver
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	responses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tigerbat",
+		Name:      "responses_total",
+		Help:      "Responses to clients by X-Cache status.",
+	}, []string{"cache"})
+	servedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tigerbat",
+		Name:      "served_bytes_total",
+		Help:      "Object bytes served to clients from cache. Compare with tigerbat_upstream_bytes_total.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(responses, servedBytes)
+}
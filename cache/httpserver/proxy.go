@@ -0,0 +1,74 @@
+package httpserver
+
+import (
+	"github.com/fkautz/tigerbat/cache/accesslog"
+	"github.com/fkautz/tigerbat/cache/logger"
+	"golang.org/x/net/context"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// newPassThroughProxy returns a reverse proxy that streams requests for
+// objects we will not cache straight to and from the upstream. Status codes
+// and headers are passed through untouched, apart from Via.
+func newPassThroughProxy(upstream *url.URL, via string, transport http.RoundTripper) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(upstream)
+	proxy.Transport = transport
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		// upstream may be a virtual host, don't leak the client's Host
+		r.Host = upstream.Host
+		r.Header.Add("Via", via)
+	}
+	proxy.FlushInterval = 100 * time.Millisecond
+	return proxy
+}
+
+// passThrough proxies a request to the upstream, reporting why the object
+// was not served from cache.
+func (s *httpHandler) passThrough(w http.ResponseWriter, r *http.Request, reasons []string) {
+	if len(reasons) > 0 {
+		w.Header().Set("X-Cache-Bypass-Reason", strings.Join(reasons, ", "))
+	}
+	s.proxy.ServeHTTP(w, r)
+	logProxied(r)
+}
+
+type cacheKeyContextKey struct{}
+
+// forward proxies a request that may modify the object at the upstream,
+// streaming the request body through. The cached metadata of the object is
+// dropped once the upstream accepts the write.
+func (s *httpHandler) forward(w http.ResponseWriter, r *http.Request, key string) {
+	ctx := context.WithValue(r.Context(), cacheKeyContextKey{}, key)
+	s.proxy.ServeHTTP(w, r.WithContext(ctx))
+	logProxied(r)
+}
+
+// logProxied counts the whole body of a proxied response as upstream bytes.
+func logProxied(r *http.Request) {
+	if entry := accesslog.FromRequest(r); entry != nil {
+		entry.UpstreamBytes = entry.Bytes
+	}
+}
+
+// invalidateOnWrite is installed as the proxy's ModifyResponse hook so the
+// metadata is gone before the client sees the write succeed.
+func (s *httpHandler) invalidateOnWrite(response *http.Response) error {
+	key, ok := response.Request.Context().Value(cacheKeyContextKey{}).(string)
+	if !ok {
+		return nil
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return nil
+	}
+	if err := s.cache.Invalidate(key); err != nil {
+		// the write went through upstream, don't fail it here
+		logger.Warnln("Unable to invalidate", key, err)
+	}
+	return nil
+}
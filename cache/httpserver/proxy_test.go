@@ -0,0 +1,128 @@
+package httpserver
+
+import (
+	"errors"
+	"github.com/fkautz/tigerbat/cache/hydrator"
+	"github.com/fkautz/tigerbat/cache/memorycache"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// proxyRouter routes every path to a handler in front of upstream.
+func proxyRouter(cache hydrator.Cache, upstream string) http.Handler {
+	upstreamURL, _ := url.Parse(upstream)
+	router := mux.NewRouter()
+	router.Handle("/{request:.*}", NewHttpHandler(cache, 4, upstreamURL, http.DefaultTransport))
+	return router
+}
+
+func TestPassThrough(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		header  string
+		body    string
+		reasons []string
+		bypass  string
+	}{
+		{"uncacheable object", http.StatusOK, "no-store", "0123456789", []string{"RESPONSE_NO_STORE"}, "RESPONSE_NO_STORE"},
+		{"several reasons", http.StatusOK, "private", "0123", []string{"RESPONSE_PRIVATE", "EXPIRES_TOO_SOON"}, "RESPONSE_PRIVATE, EXPIRES_TOO_SOON"},
+		{"upstream status kept", http.StatusForbidden, "no-store", "denied", []string{"RESPONSE_NO_STORE"}, "RESPONSE_NO_STORE"},
+		{"no reason given", http.StatusOK, "no-store", "0123", nil, ""},
+	}
+	for _, test := range tests {
+		var seen *http.Request
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = r
+			w.Header().Set("Cache-Control", test.header)
+			w.Header().Set("X-Upstream", "yes")
+			w.WriteHeader(test.status)
+			w.Write([]byte(test.body))
+		}))
+		cache := new(testCache)
+		cache.On("GetMetadata", "foo/bar", mock.Anything).Return((*hydrator.CacheEntry)(nil), gcache.NotCacheable{Reasons: test.reasons})
+
+		r := httptest.NewRequest("GET", "/foo/bar?baz=1", nil)
+		r.Host = "tigerbat.example.com"
+		w := httptest.NewRecorder()
+		proxyRouter(cache, upstream.URL).ServeHTTP(w, r)
+		upstream.Close()
+
+		assert.Equal(t, test.status, w.Code, test.name)
+		assert.Equal(t, test.body, w.Body.String(), test.name)
+		assert.Equal(t, test.header, w.Header().Get("Cache-Control"), test.name)
+		assert.Equal(t, "yes", w.Header().Get("X-Upstream"), test.name)
+		assert.Equal(t, "MISS", w.Header().Get("X-Cache"), test.name)
+		assert.Equal(t, test.bypass, w.Header().Get("X-Cache-Bypass-Reason"), test.name)
+		if assert.NotNil(t, seen, test.name) {
+			assert.Equal(t, "/foo/bar", seen.URL.Path, test.name)
+			assert.Equal(t, "baz=1", seen.URL.RawQuery, test.name)
+			assert.Equal(t, strings.TrimPrefix(upstream.URL, "http://"), seen.Host, test.name)
+			assert.Contains(t, seen.Header.Get("Via"), serverName, test.name)
+		}
+	}
+}
+
+func TestForward(t *testing.T) {
+	tests := []struct {
+		method      string
+		status      int
+		invalidated bool
+	}{
+		{"PUT", http.StatusCreated, true},
+		{"POST", http.StatusOK, true},
+		{"DELETE", http.StatusAccepted, true},
+		{"PUT", http.StatusUnauthorized, false},
+		{"POST", http.StatusInternalServerError, false},
+		{"OPTIONS", http.StatusOK, true},
+	}
+	for _, test := range tests {
+		name := test.method + " " + http.StatusText(test.status)
+		var method, body string
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			buf := new(strings.Builder)
+			io.Copy(buf, r.Body)
+			method, body = r.Method, buf.String()
+			w.WriteHeader(test.status)
+			w.Write([]byte("done"))
+		}))
+		cache := new(testCache)
+		cache.On("Invalidate", "foo/bar").Return(nil)
+
+		r := httptest.NewRequest(test.method, "/foo/bar", strings.NewReader("artifact"))
+		w := httptest.NewRecorder()
+		proxyRouter(cache, upstream.URL).ServeHTTP(w, r)
+		upstream.Close()
+
+		assert.Equal(t, test.status, w.Code, name)
+		assert.Equal(t, "done", w.Body.String(), name)
+		assert.Equal(t, test.method, method, name)
+		assert.Equal(t, "artifact", body, name)
+		if test.invalidated {
+			cache.AssertCalled(t, "Invalidate", "foo/bar")
+		} else {
+			cache.AssertNotCalled(t, "Invalidate", "foo/bar")
+		}
+		cache.AssertNotCalled(t, "GetMetadata", mock.Anything, mock.Anything)
+	}
+}
+
+func TestForwardInvalidateFailureKeepsResponse(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer upstream.Close()
+	cache := new(testCache)
+	cache.On("Invalidate", "foo").Return(errors.New("etcd unavailable"))
+
+	w := httptest.NewRecorder()
+	proxyRouter(cache, upstream.URL).ServeHTTP(w, httptest.NewRequest("PUT", "/foo", strings.NewReader("x")))
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
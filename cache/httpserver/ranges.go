@@ -0,0 +1,213 @@
+package httpserver
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fkautz/tigerbat/cache/logger"
+	"github.com/fkautz/tigerbat/cache/memorycache"
+	"github.com/fkautz/tigerbat/cache/sizereaderat"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// errNoOverlap is returned by parseRange if none of the ranges overlap the
+// object.
+var errNoOverlap = errors.New("invalid range: failed to overlap")
+
+// from "net/http".httpRange
+type httpRange struct {
+	start, length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+func (r httpRange) mimeHeader(contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {r.contentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+// from "net/http".parseRange
+func parseRange(s string, size int64) ([]httpRange, error) {
+	if s == "" {
+		return nil, nil // header not present
+	}
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		return nil, errors.New("invalid range")
+	}
+	var ranges []httpRange
+	noOverlap := false
+	for _, ra := range strings.Split(s[len(b):], ",") {
+		ra = strings.TrimSpace(ra)
+		if ra == "" {
+			continue
+		}
+		i := strings.Index(ra, "-")
+		if i < 0 {
+			return nil, errors.New("invalid range")
+		}
+		start, end := strings.TrimSpace(ra[:i]), strings.TrimSpace(ra[i+1:])
+		var r httpRange
+		if start == "" {
+			// If no start is specified, end specifies the
+			// range start relative to the end of the file.
+			if end == "" || end[0] == '-' {
+				return nil, errors.New("invalid range")
+			}
+			i, err := strconv.ParseInt(end, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errors.New("invalid range")
+			}
+			if i == 0 {
+				noOverlap = true
+				continue
+			}
+			if i > size {
+				i = size
+			}
+			r.start = size - i
+			r.length = size - r.start
+		} else {
+			i, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errors.New("invalid range")
+			}
+			if i >= size {
+				// If the range begins after the size of the content,
+				// then it does not overlap.
+				noOverlap = true
+				continue
+			}
+			r.start = i
+			if end == "" {
+				// If no end is specified, range extends to end of the file.
+				r.length = size - r.start
+			} else {
+				i, err := strconv.ParseInt(end, 10, 64)
+				if err != nil || r.start > i {
+					return nil, errors.New("invalid range")
+				}
+				if i >= size {
+					i = size - 1
+				}
+				r.length = i - r.start + 1
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	if noOverlap && len(ranges) == 0 {
+		// The specified ranges did not overlap with the content.
+		return nil, errNoOverlap
+	}
+	return ranges, nil
+}
+
+// coalesceRanges sorts ranges and merges the ones that overlap or touch, so
+// that no byte is fetched from the cache twice.
+func coalesceRanges(ranges []httpRange) []httpRange {
+	if len(ranges) < 2 {
+		return ranges
+	}
+	sorted := make([]httpRange, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].start < sorted[j].start
+	})
+	coalesced := sorted[:1]
+	for _, ra := range sorted[1:] {
+		last := &coalesced[len(coalesced)-1]
+		if ra.start <= last.start+last.length {
+			if end := ra.start + ra.length; end > last.start+last.length {
+				last.length = end - last.start
+			}
+			continue
+		}
+		coalesced = append(coalesced, ra)
+	}
+	return coalesced
+}
+
+// countingWriter counts how many bytes have been written to it.
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (n int, err error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// rangesMIMESize returns the number of bytes it takes to encode the
+// provided ranges as a multipart response.
+func rangesMIMESize(ranges []httpRange, contentType string, contentSize int64) (encSize int64) {
+	var w countingWriter
+	mw := multipart.NewWriter(&w)
+	for _, ra := range ranges {
+		mw.CreatePart(ra.mimeHeader(contentType, contentSize))
+		encSize += ra.length
+	}
+	mw.Close()
+	encSize += int64(w)
+	return
+}
+
+// serveRanges writes the object, or the requested ranges of it, reading
+// each range lazily from the cache blocks so nothing is buffered beyond a
+// single block.
+func (s *httpHandler) serveRanges(w http.ResponseWriter, reader sizereaderat.SizeReaderAt, ranges []httpRange) {
+	size := reader.Size()
+	if len(ranges) > 0 {
+		// the digest covers the whole object, not a part of it
+		w.Header().Del("Content-Md5")
+	}
+	switch len(ranges) {
+	case 0:
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusOK)
+		n, err := io.Copy(w, gcache.NewLazyReader(reader, 0, size, s.blockSize))
+		servedBytes.Add(float64(n))
+		if err != nil {
+			logger.Debugln(err)
+		}
+	case 1:
+		ra := ranges[0]
+		w.Header().Set("Content-Range", ra.contentRange(size))
+		w.Header().Set("Content-Length", strconv.FormatInt(ra.length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		n, err := io.Copy(w, gcache.NewLazyReader(reader, ra.start, ra.start+ra.length, s.blockSize))
+		servedBytes.Add(float64(n))
+		if err != nil {
+			logger.Debugln(err)
+		}
+	default:
+		contentType := w.Header().Get("Content-Type")
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		mw := multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+		w.Header().Set("Content-Length", strconv.FormatInt(rangesMIMESize(ranges, contentType, size), 10))
+		w.WriteHeader(http.StatusPartialContent)
+		for _, ra := range ranges {
+			part, err := mw.CreatePart(ra.mimeHeader(contentType, size))
+			if err != nil {
+				logger.Debugln(err)
+				return
+			}
+			n, err := io.Copy(part, gcache.NewLazyReader(reader, ra.start, ra.start+ra.length, s.blockSize))
+			servedBytes.Add(float64(n))
+			if err != nil {
+				logger.Debugln(err)
+				return
+			}
+		}
+		mw.Close()
+	}
+}
@@ -0,0 +1,74 @@
+package httpserver
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	ranges, err := parseRange("bytes=0-9, -5, 95-", 100)
+	assert.Nil(t, err)
+	assert.Equal(t, []httpRange{{0, 10}, {95, 5}, {95, 5}}, ranges)
+
+	_, err = parseRange("bytes=100-200", 100)
+	assert.Equal(t, errNoOverlap, err)
+
+	_, err = parseRange("bytes=10-5", 100)
+	assert.NotNil(t, err)
+	assert.NotEqual(t, errNoOverlap, err)
+}
+
+func TestCoalesceRanges(t *testing.T) {
+	ranges := coalesceRanges([]httpRange{{50, 10}, {0, 10}, {5, 10}, {15, 5}, {55, 2}})
+	assert.Equal(t, []httpRange{{0, 20}, {50, 10}}, ranges)
+
+	ranges = coalesceRanges([]httpRange{{10, 5}})
+	assert.Equal(t, []httpRange{{10, 5}}, ranges)
+}
+
+func TestServeMultipleRanges(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+	handler := &httpHandler{blockSize: 4}
+	w := httptest.NewRecorder()
+	handler.serveRanges(w, io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), []httpRange{{2, 3}, {10, 6}})
+
+	assert.Equal(t, 206, w.Code)
+	assert.Equal(t, strconv.Itoa(w.Body.Len()), w.Header().Get("Content-Length"))
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	assert.Nil(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+
+	reader := multipart.NewReader(w.Body, params["boundary"])
+	expected := []struct {
+		contentRange string
+		body         string
+	}{
+		{"bytes 2-4/20", "234"},
+		{"bytes 10-15/20", "abcdef"},
+	}
+	for _, e := range expected {
+		part, err := reader.NextPart()
+		assert.Nil(t, err)
+		assert.Equal(t, e.contentRange, part.Header.Get("Content-Range"))
+		body, _ := ioutil.ReadAll(part)
+		assert.Equal(t, e.body, string(body))
+	}
+}
+
+func TestServeSingleRange(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+	handler := &httpHandler{blockSize: 4}
+	w := httptest.NewRecorder()
+	handler.serveRanges(w, io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), []httpRange{{3, 7}})
+
+	assert.Equal(t, 206, w.Code)
+	assert.Equal(t, "bytes 3-9/20", w.Header().Get("Content-Range"))
+	assert.Equal(t, "3456789", w.Body.String())
+}
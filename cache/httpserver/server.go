@@ -1,31 +1,47 @@
 package httpserver
 
 import (
+	"bytes"
 	"errors"
+	"github.com/fkautz/tigerbat/cache/accesslog"
 	"github.com/fkautz/tigerbat/cache/hydrator"
+	"github.com/fkautz/tigerbat/cache/logger"
 	"github.com/fkautz/tigerbat/cache/memorycache"
 	"github.com/gorilla/mux"
-	"github.com/spf13/viper"
+	"golang.org/x/net/context"
 	"io"
-	"log"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
 	"strconv"
-	"strings"
 	"time"
 )
 
-func NewHttpHandler(cache hydrator.Cache, blockSize int64) http.Handler {
-	return &httpHandler{
+func NewHttpHandler(cache hydrator.Cache, blockSize int64, upstream *url.URL, transport http.RoundTripper) http.Handler {
+	via := "1.1 " + serverName
+	if hostname, err := os.Hostname(); err == nil {
+		via = "1.1 " + hostname + " (" + serverName + ")"
+	}
+	handler := &httpHandler{
 		cache:     cache,
 		blockSize: blockSize,
+		proxy:     newPassThroughProxy(upstream, via, transport),
+		via:       via,
 	}
+	handler.proxy.ModifyResponse = handler.invalidateOnWrite
+	return handler
 }
 
 type httpHandler struct {
 	cache     hydrator.Cache
 	blockSize int64
+	proxy     *httputil.ReverseProxy
+	via       string
 }
 
+const serverName = "tigerbat/0.0.1"
+
 func (s *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// get request url
 	vars := mux.Vars(r)
@@ -36,38 +52,75 @@ func (s *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	//	return
 	//}
 
-	w.Header().Add("X-Cache-Server", "tigerbat/0.0.1")
+	w.Header().Add("X-Cache-Server", serverName)
+	w.Header().Add("Via", s.via)
+	defer func() {
+		if status := w.Header().Get("X-Cache"); status != "" {
+			responses.WithLabelValues(status).Inc()
+		}
+	}()
+
+	// only GET and HEAD are served from cache, everything else goes upstream
+	if r.Method != "GET" && r.Method != "HEAD" {
+		s.forward(w, r, request)
+		return
+	}
 
 	// get object
-	cacheEntry, err := s.cache.GetMetadata(request, r.Header)
+	cacheEntry, err := s.cache.GetMetadata(r.Context(), request, r.Header)
 	if err != nil {
-		w.WriteHeader(404)
+		if notCacheable, ok := err.(gcache.NotCacheable); ok {
+			w.Header().Set("X-Cache", "MISS")
+			s.passThrough(w, r, notCacheable.Reasons)
+			return
+		}
+		if err == gcache.ErrNotCached {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		if statusErr, ok := err.(hydrator.StatusError); ok {
+			w.WriteHeader(statusErr.StatusCode)
+			return
+		}
+		logger.Warnln("Unable to fetch metadata", request, err)
+		w.WriteHeader(errorStatus(err, http.StatusBadGateway))
 		return
 	}
 
 	// write object metadata
-	w.Header().Add("Accept-Ranges", "bytes")
-
 	for k, v := range cacheEntry.Metadata {
-		w.Header().Add(k, v)
+		w.Header().Set(k, v)
 	}
-
-	if err != nil {
-		if err.Error() == "Not Cacheable" {
-			//log.Println("Not Cacheable:", request)
-			resp, err := http.Get(viper.GetString("mirror-url") + "/" + request)
-			if err != nil {
-				log.Println(err)
-				w.WriteHeader(404)
-				return
-			}
-			io.Copy(w, resp.Body)
-			resp.Body.Close()
-			return
-		} else {
-			w.WriteHeader(404)
-			return
+	_, knownLength := cacheEntry.Metadata["Content-Length"]
+	if knownLength {
+		w.Header().Set("Accept-Ranges", "bytes")
+	} else {
+		w.Header().Set("Accept-Ranges", "none")
+	}
+	if cacheEntry.Warning != "" {
+		w.Header().Set("Warning", cacheEntry.Warning)
+	}
+	if retrieved, err := http.ParseTime(cacheEntry.Metadata["X-Cache-Date-Retrieved"]); err == nil {
+		age := time.Since(retrieved) / time.Second
+		if age < 0 {
+			age = 0
 		}
+		w.Header().Set("Age", strconv.FormatInt(int64(age), 10))
+	}
+	provenance := &hydrator.Provenance{RequestID: r.Header.Get(accesslog.RequestIDHeader)}
+	setCacheStatus(w.Header(), cacheEntry, provenance)
+	if entry := accesslog.FromRequest(r); entry != nil {
+		// the headers only know about the first block
+		defer func() {
+			entry.Tier = provenance.String()
+			entry.UpstreamBytes = provenance.UpstreamBytes()
+		}()
+	}
+
+	// answer conditional requests from the cached validators
+	modtime, _ := http.ParseTime(cacheEntry.Metadata["Last-Modified"])
+	done, rangeHeader := checkPreconditions(w, r, cacheEntry.Metadata["Etag"], modtime)
+	if done {
 		return
 	}
 
@@ -77,95 +130,126 @@ func (s *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	reader, err := s.cache.Get(request, cacheEntry)
+	if !knownLength {
+		s.serveStream(w, r, request, cacheEntry, provenance)
+		return
+	}
 
-	if w.Header().Get("Content-Length") == "" {
-		w.Header().Add("Content-Length", strconv.FormatInt(reader.Size(), 10))
+	reader, err := s.cache.Get(r.Context(), request, cacheEntry, provenance)
+	if err != nil {
+		logger.Errorln("Unable to open", request, err)
+		w.WriteHeader(errorStatus(err, http.StatusInternalServerError))
+		return
 	}
 
-	// server
-	//http.ServeContent(w, r, request, time.Now(), io.NewSectionReader(reader, 0, reader.Size()))
+	ranges, err := parseRange(rangeHeader, reader.Size())
+	if err == errNoOverlap {
+		w.Header().Set("Content-Range", "bytes */"+strconv.FormatInt(reader.Size(), 10))
+		w.Header().Del("Content-Length")
+		w.Header().Del("Content-Md5")
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if err != nil {
+		// RFC 7233 allows an invalid Range header to be ignored
+		logger.Debugln("Ignoring Range", err)
+		ranges = nil
+	}
+	ranges = coalesceRanges(ranges)
+
+	// load the first block before the headers go out so they can tell where
+	// it came from, the others are loaded while the body is written
+	if reader.Size() > 0 {
+		var offset int64
+		if len(ranges) > 0 {
+			offset = ranges[0].start
+		}
+		if _, err := reader.ReadAt(make([]byte, 1), offset); err != nil && err != io.EOF {
+			logger.Warnln("Unable to load", request, err)
+			w.WriteHeader(errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+		setCacheStatus(w.Header(), cacheEntry, provenance)
+	}
+	s.serveRanges(w, reader, ranges)
+}
 
-	// original
-	ranges, err := parseRange(r.Header.Get("Range"), reader.Size())
+// serveStream writes an object whose length isn't known yet. Ranges can't be
+// served without it, so the whole object is sent.
+func (s *httpHandler) serveStream(w http.ResponseWriter, r *http.Request, request string, cacheEntry *hydrator.CacheEntry, provenance *hydrator.Provenance) {
+	reader, err := s.cache.Stream(r.Context(), request, cacheEntry, provenance)
 	if err != nil {
-		log.Println(err)
+		logger.Errorln("Unable to open", request, err)
+		w.WriteHeader(errorStatus(err, http.StatusInternalServerError))
+		return
 	}
-	rangeSize := int64(0)
-	for _, ra := range ranges {
-		rangeSize += ra.length
+
+	// load the first block before the headers go out, as for other objects
+	first := make([]byte, 1)
+	n, err := reader.Read(first)
+	if err != nil && err != io.EOF {
+		logger.Warnln("Unable to load", request, err)
+		w.WriteHeader(errorStatus(err, http.StatusInternalServerError))
+		return
 	}
-	if rangeSize > reader.Size() {
-		ranges = nil
+	setCacheStatus(w.Header(), cacheEntry, provenance)
+	w.WriteHeader(http.StatusOK)
+	body := &failingReader{Reader: io.MultiReader(bytes.NewReader(first[:n]), reader)}
+	written, err := io.Copy(w, body)
+	servedBytes.Add(float64(written))
+	if body.err != nil {
+		// a chunked body that ends looks complete, only a broken
+		// connection tells the client it isn't
+		logger.Warnln("Unable to finish", request, body.err)
+		panic(http.ErrAbortHandler)
 	}
-	streamReader := gcache.NewLazyReader(reader, int64(0), reader.Size(), s.blockSize)
-	if ranges == nil {
-		w.WriteHeader(200)
-		io.Copy(w, streamReader)
-	} else {
-		http.ServeContent(w, r, request, time.Now(), streamReader)
+	if err != nil {
+		logger.Debugln(err)
 	}
 }
 
-// from "net/http".httpRange
-type httpRange struct {
-	start, length int64
+// failingReader remembers the error reading failed with, other than io.EOF.
+type failingReader struct {
+	io.Reader
+	err error
 }
 
-// from "net/http".parseRange
-func parseRange(s string, size int64) ([]httpRange, error) {
-	if s == "" {
-		return nil, nil // header not present
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
 	}
-	const b = "bytes="
-	if !strings.HasPrefix(s, b) {
-		return nil, errors.New("invalid range")
+	return n, err
+}
+
+// errorStatus is the status for a response that failed with err: 504 when
+// the upstream or the client's deadline timed out, 502 when the upstream
+// failed or sent something unusable and fallback otherwise.
+func errorStatus(err error, fallback int) int {
+	var upstreamErr hydrator.UpstreamError
+	var rangeErr hydrator.RangeError
+	var statusErr hydrator.StatusError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &upstreamErr) && upstreamErr.Timeout:
+		return http.StatusGatewayTimeout
+	case errors.As(err, &upstreamErr), errors.As(err, &rangeErr), errors.As(err, &statusErr), errors.Is(err, hydrator.ErrChanged):
+		return http.StatusBadGateway
 	}
-	var ranges []httpRange
-	for _, ra := range strings.Split(s[len(b):], ",") {
-		ra = strings.TrimSpace(ra)
-		if ra == "" {
-			continue
-		}
-		i := strings.Index(ra, "-")
-		if i < 0 {
-			return nil, errors.New("invalid range")
-		}
-		start, end := strings.TrimSpace(ra[:i]), strings.TrimSpace(ra[i+1:])
-		var r httpRange
-		if start == "" {
-			// If no start is specified, end specifies the
-			// range start relative to the end of the file.
-			i, err := strconv.ParseInt(end, 10, 64)
-			if err != nil {
-				return nil, errors.New("invalid range")
-			}
-			if i > size {
-				i = size
-			}
-			r.start = size - i
-			r.length = size - r.start
-		} else {
-			i, err := strconv.ParseInt(start, 10, 64)
-			if err != nil || i >= size || i < 0 {
-				return nil, errors.New("invalid range")
-			}
-			r.start = i
-			if end == "" {
-				// If no end is specified, range extends to end of the file.
-				r.length = size - r.start
-			} else {
-				i, err := strconv.ParseInt(end, 10, 64)
-				if err != nil || r.start > i {
-					return nil, errors.New("invalid range")
-				}
-				if i >= size {
-					i = size - 1
-				}
-				r.length = i - r.start + 1
-			}
-		}
-		ranges = append(ranges, r)
+	return fallback
+}
+
+// setCacheStatus reports how a response was served. X-Cache is STALE for
+// expired metadata, MISS when anything came from the upstream and HIT
+// otherwise. X-Cache-Tier lists the tiers the blocks read so far came from.
+func setCacheStatus(header http.Header, cacheEntry *hydrator.CacheEntry, provenance *hydrator.Provenance) {
+	status := "HIT"
+	if cacheEntry.Warning != "" {
+		status = "STALE"
+	} else if !cacheEntry.Hit || provenance.FromUpstream() {
+		status = "MISS"
+	}
+	header.Set("X-Cache", status)
+	if tiers := provenance.String(); tiers != "" {
+		header.Set("X-Cache-Tier", tiers)
 	}
-	return ranges, nil
 }
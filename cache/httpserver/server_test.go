@@ -0,0 +1,175 @@
+package httpserver
+
+import (
+	"errors"
+	"github.com/fkautz/tigerbat/cache/hydrator"
+	"github.com/fkautz/tigerbat/cache/memorycache"
+	"github.com/gorilla/mux"
+	"github.com/pquerna/cachecontrol/cacheobject"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestErrorStatus(t *testing.T) {
+	assert.Equal(t, http.StatusGatewayTimeout, errorStatus(context.DeadlineExceeded, 500))
+	assert.Equal(t, http.StatusGatewayTimeout, errorStatus(hydrator.UpstreamError{Err: errors.New("timeout"), Timeout: true}, 500))
+	assert.Equal(t, http.StatusBadGateway, errorStatus(hydrator.UpstreamError{Err: io.ErrUnexpectedEOF}, 500))
+	assert.Equal(t, http.StatusBadGateway, errorStatus(hydrator.RangeError{Reason: "whole object"}, 500))
+	assert.Equal(t, http.StatusBadGateway, errorStatus(hydrator.StatusError{StatusCode: 503}, 500))
+	assert.Equal(t, http.StatusInternalServerError, errorStatus(errors.New("disk"), 500))
+}
+
+func TestServeMetadataErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{"not found", hydrator.StatusError{StatusCode: http.StatusNotFound}, http.StatusNotFound},
+		{"gone", hydrator.StatusError{StatusCode: http.StatusGone}, http.StatusGone},
+		{"forbidden", hydrator.StatusError{StatusCode: http.StatusForbidden}, http.StatusForbidden},
+		{"only if cached", gcache.ErrNotCached, http.StatusGatewayTimeout},
+		{"upstream down", hydrator.UpstreamError{Err: errors.New("connection refused")}, http.StatusBadGateway},
+		{"upstream timeout", hydrator.UpstreamError{Err: errors.New("timeout"), Timeout: true}, http.StatusGatewayTimeout},
+	}
+	for _, test := range tests {
+		cache := new(testCache)
+		cache.On("GetMetadata", "foo", mock.Anything).Return((*hydrator.CacheEntry)(nil), test.err)
+		upstream, _ := url.Parse("http://localhost:9000")
+		router := mux.NewRouter()
+		router.Handle("/{request:.*}", NewHttpHandler(cache, 4, upstream, http.DefaultTransport))
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/foo", nil))
+		assert.Equal(t, test.status, w.Code, test.name)
+	}
+}
+
+func TestCacheStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		hit     bool
+		warning string
+		path    string
+		status  string
+		tiers   string
+	}{
+		{"fresh metadata from memory", true, "", hydrator.TierMemory, "HIT", "memory"},
+		{"fresh metadata from a peer's disk", true, "", "peer=10.0.0.3:8000,disk", "HIT", "peer=10.0.0.3:8000,disk"},
+		{"block from the upstream", true, "", "peer=10.0.0.3:8000,upstream", "MISS", "peer=10.0.0.3:8000,upstream"},
+		{"metadata from the upstream", false, "", hydrator.TierDisk, "MISS", "disk"},
+		{"stale metadata", true, hydrator.WarningResponseIsStale, hydrator.TierUpstream, "STALE", "upstream"},
+		{"nothing read yet", true, "", "", "HIT", ""},
+	}
+	for _, test := range tests {
+		provenance := &hydrator.Provenance{}
+		if test.path != "" {
+			provenance.Add(0, test.path)
+		}
+		header := http.Header{}
+		setCacheStatus(header, &hydrator.CacheEntry{Hit: test.hit, Warning: test.warning}, provenance)
+		assert.Equal(t, test.status, header.Get("X-Cache"), test.name)
+		assert.Equal(t, test.tiers, header.Get("X-Cache-Tier"), test.name)
+	}
+}
+
+func TestServeReportsTiers(t *testing.T) {
+	cacheEntry := &hydrator.CacheEntry{
+		ObjectResults: &cacheobject.ObjectResults{},
+		Metadata: map[string]string{
+			"Content-Length":         "10",
+			"X-Cache-Date-Retrieved": time.Now().Add(-90 * time.Second).UTC().Format(http.TimeFormat),
+		},
+		Hit: true,
+	}
+	cache := new(testCache)
+	cache.On("GetMetadata", "foo", mock.Anything).Return(cacheEntry, nil)
+	cache.On("Get", "foo", cacheEntry, mock.Anything).Run(func(args mock.Arguments) {
+		args.Get(2).(*hydrator.Provenance).Add(0, "peer=10.0.0.3:8000,disk")
+	}).Return(strings.NewReader("0123456789"), nil)
+	upstream, _ := url.Parse("http://localhost:9000")
+	router := mux.NewRouter()
+	router.Handle("/{request:.*}", NewHttpHandler(cache, 4, upstream, http.DefaultTransport))
+
+	hits := testutil.ToFloat64(responses.WithLabelValues("HIT"))
+	served := testutil.ToFloat64(servedBytes)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/foo", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0123456789", w.Body.String())
+	assert.Equal(t, hits+1, testutil.ToFloat64(responses.WithLabelValues("HIT")))
+	assert.Equal(t, served+10, testutil.ToFloat64(servedBytes))
+	assert.Equal(t, "HIT", w.Header().Get("X-Cache"))
+	assert.Equal(t, "peer=10.0.0.3:8000,disk", w.Header().Get("X-Cache-Tier"))
+	assert.Equal(t, serverName, w.Header().Get("X-Cache-Server"))
+	assert.True(t, strings.HasPrefix(w.Header().Get("Via"), "1.1 "))
+	assert.Contains(t, w.Header().Get("Via"), serverName)
+	age, err := strconv.Atoi(w.Header().Get("Age"))
+	assert.Nil(t, err)
+	assert.InDelta(t, 90, age, 2)
+}
+
+func TestServeUnknownLength(t *testing.T) {
+	cacheEntry := &hydrator.CacheEntry{
+		ObjectResults: &cacheobject.ObjectResults{},
+		Metadata:      map[string]string{"Content-Type": "text/plain"},
+		Spooled:       true,
+	}
+	cache := new(testCache)
+	cache.On("GetMetadata", "foo", mock.Anything).Return(cacheEntry, nil)
+	cache.On("Stream", "foo", cacheEntry, mock.Anything).Return(strings.NewReader("0123456789"), nil)
+	upstream, _ := url.Parse("http://localhost:9000")
+	router := mux.NewRouter()
+	router.Handle("/{request:.*}", NewHttpHandler(cache, 4, upstream, http.DefaultTransport))
+
+	r := httptest.NewRequest("GET", "/foo", nil)
+	r.Header.Set("Range", "bytes=2-4")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "none", w.Header().Get("Accept-Ranges"))
+	assert.Equal(t, "0123456789", w.Body.String())
+}
+
+func TestServeUnknownLengthAbortsOnFailure(t *testing.T) {
+	cacheEntry := &hydrator.CacheEntry{
+		ObjectResults: &cacheobject.ObjectResults{},
+		Metadata:      map[string]string{},
+		Spooled:       true,
+	}
+	// more than the server buffers, so the headers are out when it fails
+	sent := strings.Repeat("0123456789", 10000)
+	failed := io.MultiReader(strings.NewReader(sent), iotest.ErrReader(hydrator.UpstreamError{Err: io.ErrUnexpectedEOF}))
+	cache := new(testCache)
+	cache.On("GetMetadata", "foo", mock.Anything).Return(cacheEntry, nil)
+	cache.On("Stream", "foo", cacheEntry, mock.Anything).Return(failed, nil)
+	upstream, _ := url.Parse("http://localhost:9000")
+	router := mux.NewRouter()
+	router.Handle("/{request:.*}", NewHttpHandler(cache, 4, upstream, http.DefaultTransport))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/foo")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	body, err := ioutil.ReadAll(response.Body)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.True(t, strings.HasPrefix(sent, string(body)))
+}
@@ -0,0 +1,47 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"github.com/fkautz/tigerbat/cache/hydrator"
+	"github.com/fkautz/tigerbat/cache/logger"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sort"
+)
+
+// NewStatusHandler serves the endpoints load balancers and operators poll.
+//
+//	GET /healthz  the process is up
+//	GET /readyz   the node can serve requests, 503 with the failed checks if not
+//	GET /status   the node, its peers and its checks as JSON
+func NewStatusHandler(cache hydrator.Cache) http.Handler {
+	router := mux.NewRouter()
+	router.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	router.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		status := cache.Status()
+		if status.Ready {
+			w.Write([]byte("ok\n"))
+			return
+		}
+		var failed []string
+		for name, result := range status.Checks {
+			if result != "ok" {
+				failed = append(failed, name+": "+result+"\n")
+			}
+		}
+		sort.Strings(failed)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, line := range failed {
+			w.Write([]byte(line))
+		}
+	})
+	router.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(cache.Status()); err != nil {
+			logger.Warnln("Unable to write status", err)
+		}
+	})
+	return router
+}
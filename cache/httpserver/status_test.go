@@ -0,0 +1,56 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"github.com/fkautz/tigerbat/cache/hydrator"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadyz(t *testing.T) {
+	cache := new(testCache)
+	cache.On("Status").Return(&hydrator.Status{
+		Ready:  false,
+		Checks: map[string]string{"etcd": "ok", "upstream": "connection refused"},
+	}).Once()
+	cache.On("Status").Return(&hydrator.Status{
+		Ready:  true,
+		Checks: map[string]string{"etcd": "ok", "upstream": "ok"},
+	}).Once()
+	handler := NewStatusHandler(cache)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "upstream: connection refused\n", w.Body.String())
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestStatusJSON(t *testing.T) {
+	cache := new(testCache)
+	cache.On("Status").Return(&hydrator.Status{
+		Self:   "http://10.0.0.1:8000",
+		Role:   hydrator.RoleMember,
+		Peers:  []string{"http://10.0.0.1:8000"},
+		Ready:  false,
+		Checks: map[string]string{"upstream": "connection refused"},
+	})
+
+	w := httptest.NewRecorder()
+	NewStatusHandler(cache).ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var status map[string]interface{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, map[string]interface{}{
+		"self":   "http://10.0.0.1:8000",
+		"role":   hydrator.RoleMember,
+		"peers":  []interface{}{"http://10.0.0.1:8000"},
+		"ready":  false,
+		"checks": map[string]interface{}{"upstream": "connection refused"},
+	}, status)
+}
@@ -3,20 +3,125 @@ package hydrator
 import (
 	"github.com/fkautz/tigerbat/cache/sizereaderat"
 	"github.com/pquerna/cachecontrol/cacheobject"
+	"golang.org/x/net/context"
+	"io"
 	"net/http"
+	"time"
+)
+
+// Warnings added to stale responses, see RFC 7234 section 5.5.
+const (
+	WarningResponseIsStale    = `110 - "Response is Stale"`
+	WarningRevalidationFailed = `111 - "Revalidation Failed"`
 )
 
 type Cache interface {
-	Get(url string, cacheEntry *CacheEntry) (sizereaderat.SizeReaderAt, error)
-	GetMetadata(url string, clientHeaders http.Header) (*CacheEntry, error)
+	// Get returns a reader over the object. The tiers its blocks are read
+	// from are added to provenance, which may be nil. Reads fail once ctx
+	// is done, blocks other requests wait for are loaded regardless.
+	Get(ctx context.Context, url string, cacheEntry *CacheEntry, provenance *Provenance) (sizereaderat.SizeReaderAt, error)
+	GetMetadata(ctx context.Context, url string, clientHeaders http.Header) (*CacheEntry, error)
+	// Stream returns the body of an object without a Content-Length,
+	// spooling it to the cache as it is read.
+	Stream(ctx context.Context, url string, cacheEntry *CacheEntry, provenance *Provenance) (io.Reader, error)
+	Invalidate(url string) error
+
+	// Purge drops the metadata of url, of every url starting with prefix or
+	// of everything on every node. Purged objects are keyed by a new
+	// generation, so their blocks are fetched again and the old ones age
+	// out of memory and disk.
+	Purge(url string) error
+	PurgePrefix(prefix string) error
+	PurgeAll() error
+	// PurgeTag purges every url whose object carries tag.
+	PurgeTag(tag string) error
+
+	Status() *Status
+
+	// Leave hands this node's share of the objects to its peers ahead of a
+	// shutdown, Shutdown stops serving peers and closes the disk cache.
+	Leave() error
+	Shutdown() error
 }
 
 type CacheEntry struct {
 	ObjectResults *cacheobject.ObjectResults
 	Metadata      map[string]string
+
+	// Vary lists the request headers the representation was selected on,
+	// Variant their values for this entry.
+	Vary    []string
+	Variant map[string]string
+
+	// Tags are the surrogate keys the upstream labeled the object with.
+	Tags []string
+
+	// Location is where the upstream redirected to, nil if it didn't.
+	// The object is still cached under the url that was requested.
+	Location *Location
+
+	// NoRanges is set when the upstream ignores Range for the object, its
+	// blocks are cut from a single fetch of the whole object.
+	NoRanges bool
+	// Spooled is set when the upstream didn't tell the object's length. Its
+	// Content-Length is filled in once it has been fetched in full, its
+	// blocks stay keyed without it.
+	Spooled bool
+
+	// How long past expiration the entry may still be served while it is
+	// revalidated, or when revalidation fails (RFC 5861).
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+	// MustRevalidate forbids serving the entry once it has expired.
+	MustRevalidate bool
+
+	// StatusCode is set on negative entries, which remember that the
+	// upstream answered with an error instead of an object.
+	StatusCode int
+
+	// Warning is set on entries handed out past their expiration, Hit on
+	// entries handed out without asking the upstream.
+	Warning string
+	Hit     bool
+
+	// SyncedAt is when the entry was last shared with the cluster.
+	SyncedAt time.Time
+
+	// RequestID is passed on to the upstream so the request can be traced
+	// back to the client's. It is only set for the lookup, never stored.
+	RequestID string
+}
+
+// StaleWindow returns how long past expiration the entry may be served,
+// given the upstream's window and an operator configured grace period.
+func (entry *CacheEntry) StaleWindow(window, grace time.Duration) time.Duration {
+	if entry.MustRevalidate {
+		return 0
+	}
+	if grace > window {
+		return grace
+	}
+	return window
+}
+
+// StaleUntil returns the last moment the entry may be served at all.
+func (entry *CacheEntry) StaleUntil(grace time.Duration) time.Time {
+	window := entry.StaleWindow(entry.StaleWhileRevalidate, grace)
+	if errWindow := entry.StaleWindow(entry.StaleIfError, grace); errWindow > window {
+		window = errWindow
+	}
+	return entry.ObjectResults.OutExpirationTime.Add(window)
 }
 
 type Hydrator interface {
-	Get(url string, offset int64, length int64) ([]byte, error)
-	GetMetadata(url string) (*CacheEntry, error)
+	Get(ctx context.Context, url string, cacheEntry *CacheEntry, offset int64, length int64) ([]byte, error)
+	// GetInto is Get writing to dst as the bytes arrive.
+	GetInto(ctx context.Context, url string, cacheEntry *CacheEntry, offset int64, length int64, dst io.WriterAt) error
+	// GetWhole fetches the whole object in one request, handing it to block
+	// in blockSize pieces as it arrives.
+	GetWhole(ctx context.Context, url string, cacheEntry *CacheEntry, blockSize int64, block func(index int64, data []byte) error) error
+	GetMetadata(ctx context.Context, url string, clientHeaders http.Header) (*CacheEntry, error)
+	Revalidate(ctx context.Context, url string, cacheEntry *CacheEntry) (*CacheEntry, error)
+	// Ping checks that the upstream answers.
+	Ping() error
 }
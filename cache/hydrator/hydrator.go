@@ -1,82 +1,431 @@
 package hydrator
 
 import (
-	"crypto/tls"
 	"errors"
+	"github.com/fkautz/tigerbat/cache/accesslog"
+	"github.com/fkautz/tigerbat/cache/logger"
 	"github.com/pquerna/cachecontrol/cacheobject"
-	"io/ioutil"
-	"log"
+	"golang.org/x/net/context"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-func NewHydrator(urlRoot string) Hydrator {
+// StatusError is returned when the upstream answers with a status other than
+// the object.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e StatusError) Error() string {
+	return "Unexpected status: " + strconv.Itoa(e.StatusCode)
+}
+
+// ErrChanged is returned when a block came from another version of the
+// object than its metadata, the metadata has to be fetched again.
+var ErrChanged = errors.New("The object changed upstream")
+
+// ErrRangesIgnored is returned when the upstream answers a block request
+// with the whole object, the object has to be fetched with GetWhole.
+var ErrRangesIgnored = errors.New("The upstream ignores Range")
+
+// RangeError is returned when the upstream answers a block request with
+// something else than the range that was asked for.
+type RangeError struct {
+	Reason string
+}
+
+func (e RangeError) Error() string {
+	return "Bad range response: " + e.Reason
+}
+
+// UpstreamError is returned when the upstream could not be reached or
+// stopped sending, after retrying. Timeout is set when it didn't answer in
+// time.
+type UpstreamError struct {
+	Err     error
+	Timeout bool
+}
+
+func (e UpstreamError) Error() string {
+	return "Upstream failed: " + e.Err.Error()
+}
+
+func (e UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// NewHydrator returns a hydrator for the upstream at urlRoot. transport is
+// meant to be shared by everything talking to the upstream, see NewTransport.
+func NewHydrator(urlRoot string, transport http.RoundTripper) Hydrator {
 	return &hydratorImpl{
-		urlRoot: urlRoot,
+		urlRoot:   urlRoot,
+		client:    http.Client{Transport: transport},
+		locations: make(map[string]*Location),
 	}
 }
 
 type hydratorImpl struct {
 	urlRoot string
 	client  http.Client
+
+	// locations refreshed since the metadata was retrieved
+	locations     map[string]*Location
+	locationsLock sync.Mutex
 }
 
-func (h *hydratorImpl) Get(key string, start int64, end int64) ([]byte, error) {
-	url := h.urlRoot + "/" + key
-	log.Println("get", url, start, end)
+// Get fetches the bytes from start up to end of key. Anything but exactly
+// that range is an error, transient failures are retried.
+func (h *hydratorImpl) Get(ctx context.Context, key string, cacheEntry *CacheEntry, start int64, end int64) ([]byte, error) {
+	if end <= start {
+		return []byte{}, nil
+	}
+	data := make([]byte, end-start)
+	if err := h.GetInto(ctx, key, cacheEntry, start, end, blockWriter(data)); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
 
-	h.client.Transport = &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		},
+// GetInto fetches like Get, writing the bytes to dst as they arrive. Writes
+// are at offsets relative to start, a retry writes from the beginning again.
+func (h *hydratorImpl) GetInto(ctx context.Context, key string, cacheEntry *CacheEntry, start int64, end int64, dst io.WriterAt) error {
+	if end <= start {
+		return nil
 	}
+	return retry(ctx, func() error {
+		return h.getRange(ctx, key, cacheEntry, start, end, dst)
+	})
+}
 
+// blockWriter writes into a block of the size of the range.
+type blockWriter []byte
+
+func (b blockWriter) WriteAt(p []byte, off int64) (int, error) {
+	return copy(b[off:], p), nil
+}
+
+// streamChunk is how much of a range is read before it is handed on.
+const streamChunk = 32 * 1024
+
+func (h *hydratorImpl) getRange(ctx context.Context, key string, cacheEntry *CacheEntry, start int64, end int64, dst io.WriterAt) error {
+	url := h.urlRoot + "/" + key
+	target := url
+	if location := h.location(key, cacheEntry.Location); location != nil {
+		target = location.Url
+	}
 	byteRange := "bytes=" + strconv.FormatInt(start, 10) + "-" + strconv.FormatInt(end-1, 10)
 
-	request, err := http.NewRequest("GET", url, nil)
+	request, err := http.NewRequest("GET", target, nil)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	request = request.WithContext(ctx)
+	setVariant(request.Header, cacheEntry.Variant)
+	if cacheEntry.RequestID != "" {
+		request.Header.Set(accesslog.RequestIDHeader, cacheEntry.RequestID)
 	}
-	log.Println("Range", byteRange)
 	request.Header.Add("Range", byteRange)
-	request.Close = true
-	response, err := h.client.Do(request)
+	if validator := ifRange(cacheEntry.Metadata); validator != "" {
+		request.Header.Set("If-Range", validator)
+	}
+	response, redirected, err := do(&h.client, request)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if redirected != nil {
+		h.setLocation(key, redirected)
+	}
+	if target != url && response.StatusCode >= 400 {
+		// the location was revoked early, start over from the upstream
+		response.Body.Close()
+		h.setLocation(key, nil)
+		withoutLocation := *cacheEntry
+		withoutLocation.Location = nil
+		return h.getRange(ctx, key, &withoutLocation, start, end, dst)
+	}
+	defer response.Body.Close()
+	if (response.StatusCode == http.StatusOK || response.StatusCode == http.StatusPartialContent) && changed(response, cacheEntry.Metadata) {
+		return ErrChanged
+	}
+	if response.StatusCode != http.StatusPartialContent {
+		if response.StatusCode == http.StatusOK {
+			return ErrRangesIgnored
+		}
+		return StatusError{StatusCode: response.StatusCode}
+	}
+	if err := checkContentRange(response.Header.Get("Content-Range"), start, end, cacheEntry.Metadata["Content-Length"]); err != nil {
+		return err
 	}
-	data, err := ioutil.ReadAll(response.Body)
 
-	response.Body.Close()
-	if err != nil {
-		return nil, err
+	// read one byte more than asked for to notice a body that is too long
+	body := io.LimitReader(response.Body, end-start+1)
+	buf := make([]byte, streamChunk)
+	var offset int64
+	for {
+		n, err := body.Read(buf)
+		upstreamBytes.Add(float64(n))
+		if offset+int64(n) > end-start {
+			return RangeError{Reason: "the body is longer than the range"}
+		}
+		if n > 0 {
+			if _, err := dst.WriteAt(buf[:n], offset); err != nil {
+				return err
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
 	}
-	return data, nil
+	if offset < end-start {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// GetWhole fetches all of key in one request, for upstreams that ignore
+// Range or objects of unknown length. Transient failures are retried from
+// the start, so block may be handed the same piece more than once.
+func (h *hydratorImpl) GetWhole(ctx context.Context, key string, cacheEntry *CacheEntry, blockSize int64, block func(index int64, data []byte) error) error {
+	return retry(ctx, func() error {
+		return h.getWhole(ctx, key, cacheEntry, blockSize, block)
+	})
 }
 
-func (h *hydratorImpl) GetMetadata(key string) (*CacheEntry, error) {
+func (h *hydratorImpl) getWhole(ctx context.Context, key string, cacheEntry *CacheEntry, blockSize int64, block func(index int64, data []byte) error) error {
+	// without a Content-Length the object is read until the upstream is done
+	size := int64(-1)
+	if contentLength := cacheEntry.Metadata["Content-Length"]; contentLength != "" {
+		var err error
+		size, err = strconv.ParseInt(contentLength, 10, 64)
+		if err != nil {
+			return err
+		}
+	}
 	url := h.urlRoot + "/" + key
-	request, err := http.NewRequest("HEAD", url, nil)
+	target := url
+	if location := h.location(key, cacheEntry.Location); location != nil {
+		target = location.Url
+	}
+
+	request, err := http.NewRequest("GET", target, nil)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	request = request.WithContext(ctx)
+	setVariant(request.Header, cacheEntry.Variant)
+	if cacheEntry.RequestID != "" {
+		request.Header.Set(accesslog.RequestIDHeader, cacheEntry.RequestID)
 	}
-	response, err := http.DefaultClient.Do(request)
+	response, redirected, err := do(&h.client, request)
 	if err != nil {
-		log.Println(err)
-		return nil, err
+		return err
+	}
+	if redirected != nil {
+		h.setLocation(key, redirected)
+	}
+	if target != url && response.StatusCode >= 400 {
+		// the location was revoked early, start over from the upstream
+		response.Body.Close()
+		h.setLocation(key, nil)
+		withoutLocation := *cacheEntry
+		withoutLocation.Location = nil
+		return h.getWhole(ctx, key, &withoutLocation, blockSize, block)
 	}
+	defer response.Body.Close()
 	if response.StatusCode != http.StatusOK {
-		return nil, errors.New("Unexpected status: " + strconv.Itoa(response.StatusCode))
+		return StatusError{StatusCode: response.StatusCode}
+	}
+	if changed(response, cacheEntry.Metadata) {
+		return ErrChanged
+	}
+	if size >= 0 && response.ContentLength >= 0 && response.ContentLength != size {
+		return RangeError{Reason: "the length doesn't match the object's size"}
+	}
+
+	var offset int64
+	for index := int64(0); size < 0 || offset < size; index++ {
+		data := make([]byte, blockSize)
+		n, err := io.ReadFull(response.Body, data)
+		upstreamBytes.Add(float64(n))
+		offset += int64(n)
+		last := false
+		if size < 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			if err == io.EOF {
+				return nil
+			}
+			last = true
+		} else if err != nil && !(err == io.ErrUnexpectedEOF && offset == size) {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if err := block(index, data[:n]); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+	return nil
+}
+
+// ifRange is the validator block requests are conditional on, so that the
+// upstream only sends a range of the version the blocks are keyed by. Weak
+// Etags can't be used with If-Range.
+func ifRange(metadata map[string]string) string {
+	if etag := metadata["Etag"]; etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return metadata["Last-Modified"]
+}
+
+// changed reports whether response is of another version of the object than
+// metadata describes.
+func changed(response *http.Response, metadata map[string]string) bool {
+	if etag := metadata["Etag"]; etag != "" {
+		return response.Header.Get("Etag") != "" && response.Header.Get("Etag") != etag
+	}
+	if lastModified := metadata["Last-Modified"]; lastModified != "" {
+		return response.Header.Get("Last-Modified") != "" && response.Header.Get("Last-Modified") != lastModified
+	}
+	return false
+}
+
+// checkContentRange checks that contentRange is bytes start to end-1 of an
+// object of size bytes, if the size is known.
+func checkContentRange(contentRange string, start, end int64, size string) error {
+	if !strings.HasPrefix(contentRange, "bytes ") {
+		return RangeError{Reason: "missing Content-Range"}
+	}
+	spec := strings.SplitN(strings.TrimPrefix(contentRange, "bytes "), "/", 2)
+	bounds := strings.SplitN(spec[0], "-", 2)
+	if len(spec) != 2 || len(bounds) != 2 {
+		return RangeError{Reason: "malformed Content-Range " + contentRange}
+	}
+	first, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil {
+		return RangeError{Reason: "malformed Content-Range " + contentRange}
+	}
+	last, err := strconv.ParseInt(bounds[1], 10, 64)
+	if err != nil {
+		return RangeError{Reason: "malformed Content-Range " + contentRange}
+	}
+	if first != start || last != end-1 {
+		return RangeError{Reason: "Content-Range " + contentRange + " doesn't match the range asked for"}
+	}
+	if size != "" && spec[1] != "*" && spec[1] != size {
+		return RangeError{Reason: "Content-Range " + contentRange + " doesn't match the object's size " + size}
+	}
+	return nil
+}
+
+// GetMetadata sends a HEAD for key, or a GET for its first byte when the
+// upstream doesn't answer HEAD or leaves out the length. The client's headers
+// are forwarded so that the upstream selects the representation the client
+// would get.
+func (h *hydratorImpl) GetMetadata(ctx context.Context, key string, clientHeaders http.Header) (*CacheEntry, error) {
+	var cacheEntry *CacheEntry
+	err := retry(ctx, func() error {
+		var err error
+		cacheEntry, err = h.getMetadata(ctx, key, clientHeaders, nil)
+		return err
+	})
+	return cacheEntry, err
+}
+
+// Revalidate sends a conditional HEAD for an expired entry. When the
+// upstream answers 304 the entry is extended with its metadata untouched, so
+// the blocks cached under its key stay valid.
+func (h *hydratorImpl) Revalidate(ctx context.Context, key string, cacheEntry *CacheEntry) (*CacheEntry, error) {
+	var revalidated *CacheEntry
+	err := retry(ctx, func() error {
+		var err error
+		revalidated, err = h.getMetadata(ctx, key, nil, cacheEntry)
+		return err
+	})
+	return revalidated, err
+}
+
+// Ping sends a HEAD for the root of the upstream. Any answer but a server
+// error will do.
+func (h *hydratorImpl) Ping() error {
+	request, err := http.NewRequest("HEAD", h.urlRoot+"/", nil)
+	if err != nil {
+		return err
+	}
+	client := http.Client{Transport: h.client.Transport, Timeout: 5 * time.Second}
+	start := time.Now()
+	response, err := client.Do(request)
+	observeUpstream(request.Method, response, start)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 500 {
+		return StatusError{StatusCode: response.StatusCode}
+	}
+	return nil
+}
+
+func (h *hydratorImpl) getMetadata(ctx context.Context, key string, clientHeaders http.Header, previous *CacheEntry) (*CacheEntry, error) {
+	url := h.urlRoot + "/" + key
+	request, response, location, err := h.metadataRequest(ctx, "HEAD", url, clientHeaders, previous)
+	if err != nil {
+		logger.Debugln("Unable to fetch metadata", url, err)
+		return nil, err
+	}
+	if needsProbe(response) {
+		// the first byte comes with the same headers and the size in its
+		// Content-Range
+		logger.Debugln("Falling back to GET for metadata", url, response.StatusCode)
+		request, response, location, err = h.metadataRequest(ctx, "GET", url, clientHeaders, previous)
+		if err != nil {
+			logger.Debugln("Unable to fetch metadata", url, err)
+			return nil, err
+		}
+	}
+	h.setLocation(key, location)
+	if previous != nil && response.StatusCode == http.StatusNotModified {
+		return extendCacheEntry(request, response, previous, location)
 	}
 	// log.Println(response.Header)
 
 	metadata := make(map[string]string)
-	SetIfNotEmpty(metadata, response.Header, "Content-Encodling")
-	SetIfNotEmpty(metadata, response.Header, "Content-Length")
-	SetIfNotEmpty(metadata, response.Header, "Content-MD5")
+	noRanges := false
+	switch response.StatusCode {
+	case http.StatusOK:
+		SetIfNotEmpty(metadata, response.Header, "Content-Length")
+		SetIfNotEmpty(metadata, response.Header, "Content-MD5")
+		// a GET answered with the whole object
+		noRanges = request.Method == "GET"
+	case http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		// 416 is what an empty object answers to a request for its first byte
+		if request.Method != "GET" {
+			return nil, StatusError{StatusCode: response.StatusCode}
+		}
+		if size := contentRangeSize(response.Header.Get("Content-Range")); size != "" {
+			metadata["Content-Length"] = size
+		} else if response.StatusCode != http.StatusPartialContent {
+			return nil, StatusError{StatusCode: response.StatusCode}
+		}
+	default:
+		return nil, StatusError{StatusCode: response.StatusCode}
+	}
+	SetIfNotEmpty(metadata, response.Header, "Accept-Ranges")
+	SetIfNotEmpty(metadata, response.Header, "Content-Encoding")
 	SetIfNotEmpty(metadata, response.Header, "Content-Type")
 	SetIfNotEmpty(metadata, response.Header, "Etag")
 	SetIfNotEmpty(metadata, response.Header, "Last-Modified")
+	SetIfNotEmpty(metadata, response.Header, "Vary")
 
 	// Always set
 	metadata["X-Cache-Date-Retrieved"] = response.Header.Get("Date")
@@ -88,15 +437,141 @@ func (h *hydratorImpl) GetMetadata(key string) (*CacheEntry, error) {
 	//metadata["Etag"] = response.Header.Get("Etag")
 	//metadata["Last-Modified"] = response.Header.Get("Last-Modified")
 
-	cacheResults, err := getCacheResult(request, response)
+	// the object is what is cached, not the part of it that was probed
+	whole := *response
+	whole.StatusCode = http.StatusOK
+	cacheResults, resDir, err := getCacheResult(request, &whole)
 	if err != nil {
 		return nil, err
 	}
 	//log.Println("h", metadata)
+	cacheEntry := newCacheEntry(metadata, location, cacheResults, resDir)
+	cacheEntry.Vary = parseVary(response.Header)
+	cacheEntry.Variant = Variant(cacheEntry.Vary, request.Header)
+	cacheEntry.Tags = parseTags(response.Header)
+	cacheEntry.NoRanges = noRanges
+	return cacheEntry, nil
+}
+
+// metadataRequest sends a HEAD, or a GET for the first byte, for the
+// metadata of url. The body is closed already.
+func (h *hydratorImpl) metadataRequest(ctx context.Context, method string, url string, clientHeaders http.Header, previous *CacheEntry) (*http.Request, *http.Response, *Location, error) {
+	request, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	request = request.WithContext(ctx)
+	forwardHeaders(request.Header, clientHeaders)
+	if method == "GET" {
+		request.Header.Set("Range", "bytes=0-0")
+	}
+	if previous != nil {
+		setVariant(request.Header, previous.Variant)
+		if etag := previous.Metadata["Etag"]; etag != "" {
+			request.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := previous.Metadata["Last-Modified"]; lastModified != "" {
+			request.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+	response, location, err := do(&h.client, request)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	response.Body.Close()
+	return request, response, location, nil
+}
+
+// needsProbe reports whether the metadata has to be asked for with a GET:
+// the upstream refused the HEAD, or didn't tell the object's length.
+func needsProbe(response *http.Response) bool {
+	switch response.StatusCode {
+	case http.StatusForbidden, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		// presigned object storage urls are only signed for GET
+		return true
+	case http.StatusOK:
+		return response.Header.Get("Content-Length") == ""
+	}
+	return false
+}
+
+// contentRangeSize returns the size in contentRange, empty if it is unknown.
+func contentRangeSize(contentRange string) string {
+	spec := strings.SplitN(contentRange, "/", 2)
+	if !strings.HasPrefix(contentRange, "bytes ") || len(spec) != 2 || spec[1] == "*" {
+		return ""
+	}
+	if _, err := strconv.ParseInt(spec[1], 10, 64); err != nil {
+		return ""
+	}
+	return spec[1]
+}
+
+// setVariant sets the headers a variant was selected with, so the upstream
+// returns the same representation again.
+func setVariant(header http.Header, variant map[string]string) {
+	for k, v := range variant {
+		if v == "" {
+			header.Del(k)
+		} else {
+			header.Set(k, v)
+		}
+	}
+}
+
+// extendCacheEntry applies a 304 to the entry it revalidated. The freshness
+// headers of the 304 replace the stored ones (RFC 7234 section 4.3.4), the
+// metadata the block keys are generated from is kept as is.
+func extendCacheEntry(request *http.Request, response *http.Response, previous *CacheEntry, location *Location) (*CacheEntry, error) {
+	header := make(http.Header)
+	for k, v := range previous.Metadata {
+		header.Set(k, v)
+	}
+	for k, v := range response.Header {
+		header[k] = v
+	}
+	updated := *response
+	updated.StatusCode = http.StatusOK
+	updated.Header = header
+
+	cacheResults, resDir, err := getCacheResult(request, &updated)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := make(map[string]string)
+	for k, v := range previous.Metadata {
+		metadata[k] = v
+	}
+	metadata["X-Cache-Date-Retrieved"] = response.Header.Get("Date")
+	cacheEntry := newCacheEntry(metadata, location, cacheResults, resDir)
+	cacheEntry.Vary = previous.Vary
+	cacheEntry.Variant = previous.Variant
+	cacheEntry.Tags = previous.Tags
+	cacheEntry.NoRanges = previous.NoRanges
+	cacheEntry.Spooled = previous.Spooled
+	if tags := parseTags(response.Header); len(tags) > 0 {
+		cacheEntry.Tags = tags
+	}
+	return cacheEntry, nil
+}
+
+func newCacheEntry(metadata map[string]string, location *Location, cacheResults *cacheobject.ObjectResults, resDir *cacheobject.ResponseCacheDirectives) *CacheEntry {
 	return &CacheEntry{
-		ObjectResults: cacheResults,
-		Metadata:      metadata,
-	}, nil
+		ObjectResults:        cacheResults,
+		Metadata:             metadata,
+		Location:             location,
+		StaleWhileRevalidate: deltaSeconds(resDir.StaleWhileRevalidate),
+		StaleIfError:         deltaSeconds(resDir.StaleIfError),
+		MustRevalidate:       resDir.MustRevalidate || resDir.ProxyRevalidate,
+	}
+}
+
+func deltaSeconds(seconds cacheobject.DeltaSeconds) time.Duration {
+	if seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
 }
 
 func SetIfNotEmpty(dest map[string]string, orig http.Header, key string) {
@@ -105,15 +580,15 @@ func SetIfNotEmpty(dest map[string]string, orig http.Header, key string) {
 	}
 }
 
-func getCacheResult(req *http.Request, res *http.Response) (*cacheobject.ObjectResults, error) {
+func getCacheResult(req *http.Request, res *http.Response) (*cacheobject.ObjectResults, *cacheobject.ResponseCacheDirectives, error) {
 	reqDir, err := cacheobject.ParseRequestCacheControl(req.Header.Get("Cache-Control"))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	resDir, err := cacheobject.ParseResponseCacheControl(res.Header.Get("Cache-Control"))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	expiresHeader, _ := http.ParseTime(res.Header.Get("Expires"))
 	dateHeader, _ := http.ParseTime(res.Header.Get("Date"))
@@ -141,12 +616,12 @@ func getCacheResult(req *http.Request, res *http.Response) (*cacheobject.ObjectR
 	//log.Println(rv)
 
 	if rv.OutErr != nil {
-		return nil, rv.OutErr
+		return nil, nil, rv.OutErr
 	}
 
 	//log.Println("Errors: ", rv.OutErr)
 	//log.Println("Reasons to not cache: ", rv.OutReasons)
 	//log.Println("Warning headers to add: ", rv.OutWarnings)
 	//log.Println("Expiration: ", rv.OutExpirationTime.String())
-	return &rv, nil
+	return &rv, resDir, nil
 }
@@ -0,0 +1,277 @@
+package hydrator
+
+import (
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetReportsIgnoredRanges(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0123456789"))
+	}))
+	defer upstream.Close()
+	h := NewHydrator(upstream.URL, http.DefaultTransport)
+
+	_, err := h.Get(context.Background(), "foo", &CacheEntry{}, 2, 5)
+	assert.Equal(t, ErrRangesIgnored, err)
+}
+
+func TestGetRejectsMismatchedContentRange(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Range", "bytes 0-2/10")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte("012"))
+	}))
+	defer upstream.Close()
+	h := NewHydrator(upstream.URL, http.DefaultTransport)
+
+	_, err := h.Get(context.Background(), "foo", &CacheEntry{}, 2, 5)
+	assert.IsType(t, RangeError{}, err)
+}
+
+func TestGetRetriesTransientFailures(t *testing.T) {
+	var requests int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, "bytes=2-4", r.Header.Get("Range"))
+		w.Header().Set("Content-Range", "bytes 2-4/10")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte("234"))
+	}))
+	defer upstream.Close()
+	h := NewHydrator(upstream.URL, http.DefaultTransport)
+
+	data, err := h.Get(context.Background(), "foo", &CacheEntry{Metadata: map[string]string{"Content-Length": "10"}}, 2, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, "234", string(data))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestGetRetriesShortBodies(t *testing.T) {
+	var requests int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Range", "bytes 2-4/10")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte("23"))
+	}))
+	defer upstream.Close()
+	h := NewHydrator(upstream.URL, http.DefaultTransport)
+
+	_, err := h.Get(context.Background(), "foo", &CacheEntry{}, 2, 5)
+	assert.IsType(t, UpstreamError{}, err)
+	assert.Equal(t, int32(maxAttempts), atomic.LoadInt32(&requests))
+}
+
+func TestGetDetectsChangedObject(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, `"v1"`, r.Header.Get("If-Range"))
+		w.Header().Set("Etag", `"v2"`)
+		w.Write([]byte("0123456789"))
+	}))
+	defer upstream.Close()
+	h := NewHydrator(upstream.URL, http.DefaultTransport)
+
+	_, err := h.Get(context.Background(), "foo", &CacheEntry{Metadata: map[string]string{"Etag": `"v1"`}}, 2, 5)
+	assert.Equal(t, ErrChanged, err)
+}
+
+func TestGetWholeCutsBlocks(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0123456789"))
+	}))
+	defer upstream.Close()
+	h := NewHydrator(upstream.URL, http.DefaultTransport)
+
+	var blocks []string
+	err := h.GetWhole(context.Background(), "foo", &CacheEntry{Metadata: map[string]string{"Content-Length": "10"}}, 4, func(index int64, data []byte) error {
+		assert.Equal(t, int64(len(blocks)), index)
+		blocks = append(blocks, string(data))
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"0123", "4567", "89"}, blocks)
+}
+
+func TestGetWholeReadsUnknownLength(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("01234567"))
+		w.(http.Flusher).Flush()
+	}))
+	defer upstream.Close()
+	h := NewHydrator(upstream.URL, http.DefaultTransport)
+
+	var blocks []string
+	err := h.GetWhole(context.Background(), "foo", &CacheEntry{Metadata: map[string]string{}}, 4, func(index int64, data []byte) error {
+		blocks = append(blocks, string(data))
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"0123", "4567"}, blocks)
+}
+
+func TestGetMetadataFallsBackToGet(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		assert.Equal(t, "bytes=0-0", r.Header.Get("Range"))
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Content-Range", "bytes 0-0/10")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte("0"))
+	}))
+	defer upstream.Close()
+	h := NewHydrator(upstream.URL, http.DefaultTransport)
+
+	cacheEntry, err := h.GetMetadata(context.Background(), "foo", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "10", cacheEntry.Metadata["Content-Length"])
+	assert.False(t, cacheEntry.NoRanges)
+	assert.Empty(t, cacheEntry.ObjectResults.OutReasons)
+}
+
+func TestStaleWindows(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		revalidate   time.Duration
+		ifError      time.Duration
+		grace        time.Duration
+		until        time.Duration
+	}{
+		{"max-age=60", 0, 0, 0, 0},
+		{"max-age=60", 0, 0, time.Minute, time.Minute},
+		{"max-age=60, stale-while-revalidate=30", 30 * time.Second, 0, 0, 30 * time.Second},
+		{"max-age=60, stale-if-error=600", 0, 10 * time.Minute, 0, 10 * time.Minute},
+		{"max-age=60, stale-while-revalidate=30, stale-if-error=600", 30 * time.Second, 10 * time.Minute, time.Hour, time.Hour},
+		{"max-age=60, stale-while-revalidate=30, must-revalidate", 0, 0, time.Hour, 0},
+		{"max-age=60, stale-if-error=600, proxy-revalidate", 0, 0, 0, 0},
+	}
+	for _, test := range tests {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", test.cacheControl)
+			w.Header().Set("Content-Length", "10")
+		}))
+		cacheEntry, err := NewHydrator(upstream.URL, http.DefaultTransport).GetMetadata(context.Background(), "foo", nil)
+		upstream.Close()
+		if !assert.Nil(t, err, test.cacheControl) {
+			continue
+		}
+		assert.Equal(t, test.revalidate, cacheEntry.StaleWindow(cacheEntry.StaleWhileRevalidate, 0), test.cacheControl)
+		assert.Equal(t, test.ifError, cacheEntry.StaleWindow(cacheEntry.StaleIfError, 0), test.cacheControl)
+		expiration := cacheEntry.ObjectResults.OutExpirationTime
+		assert.Equal(t, expiration.Add(test.until), cacheEntry.StaleUntil(test.grace), test.cacheControl)
+	}
+}
+
+func TestGetMetadataStatus(t *testing.T) {
+	for _, status := range []int{http.StatusNotFound, http.StatusGone, http.StatusForbidden, http.StatusServiceUnavailable} {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+		_, err := NewHydrator(upstream.URL, http.DefaultTransport).GetMetadata(context.Background(), "foo", nil)
+		upstream.Close()
+		assert.Equal(t, StatusError{StatusCode: status}, err)
+	}
+}
+
+// redirector redirects /foo to /blob, which serves ranges of 0123456789.
+func redirector(hits map[string]int, lock *sync.Mutex) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		hits[r.URL.Path]++
+		lock.Unlock()
+		switch r.URL.Path {
+		case "/foo":
+			w.Header().Set("Cache-Control", "max-age=60")
+			http.Redirect(w, r, "/blob", http.StatusFound)
+		case "/blob":
+			w.Header().Set("Content-Range", "bytes 2-4/10")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte("234"))
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+}
+
+func TestGetFollowsLocations(t *testing.T) {
+	tests := []struct {
+		name     string
+		location func(upstream string) *Location
+		hits     map[string]int
+	}{
+		{
+			name:     "redirect is followed and remembered",
+			location: func(string) *Location { return nil },
+			hits:     map[string]int{"/foo": 1, "/blob": 2},
+		},
+		{
+			name: "valid location is used right away",
+			location: func(upstream string) *Location {
+				return &Location{Url: upstream + "/blob", Expires: time.Now().Add(time.Minute)}
+			},
+			hits: map[string]int{"/blob": 2},
+		},
+		{
+			name: "expired location is refreshed",
+			location: func(upstream string) *Location {
+				return &Location{Url: upstream + "/expired", Expires: time.Now().Add(-time.Minute)}
+			},
+			hits: map[string]int{"/foo": 1, "/blob": 2},
+		},
+		{
+			name: "revoked location starts over",
+			location: func(upstream string) *Location {
+				return &Location{Url: upstream + "/revoked", Expires: time.Now().Add(time.Minute)}
+			},
+			hits: map[string]int{"/revoked": 1, "/foo": 1, "/blob": 2},
+		},
+	}
+	for _, test := range tests {
+		hits := make(map[string]int)
+		var lock sync.Mutex
+		upstream := redirector(hits, &lock)
+		h := NewHydrator(upstream.URL, http.DefaultTransport)
+		cacheEntry := &CacheEntry{
+			Metadata: map[string]string{"Content-Length": "10"},
+			Location: test.location(upstream.URL),
+		}
+
+		for i := 0; i < 2; i++ {
+			data, err := h.Get(context.Background(), "foo", cacheEntry, 2, 5)
+			assert.Nil(t, err, test.name)
+			assert.Equal(t, "234", string(data), test.name)
+		}
+		lock.Lock()
+		assert.Equal(t, test.hits, hits, test.name)
+		lock.Unlock()
+		upstream.Close()
+	}
+}
+
+func TestRedirectExpiration(t *testing.T) {
+	tests := []struct {
+		header http.Header
+		ttl    time.Duration
+	}{
+		{http.Header{"Cache-Control": {"max-age=300"}}, 300 * time.Second},
+		{http.Header{"Expires": {time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}}, time.Hour},
+		{http.Header{"Cache-Control": {"no-store"}}, defaultLocationTTL},
+		{http.Header{"Expires": {"0"}}, defaultLocationTTL},
+	}
+	for _, test := range tests {
+		expires := redirectExpiration(&http.Response{Header: test.header})
+		assert.WithinDuration(t, time.Now().Add(test.ttl), expires, 2*time.Second, test.header)
+	}
+}
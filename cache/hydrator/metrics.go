@@ -0,0 +1,51 @@
+package hydrator
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	upstreamRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tigerbat",
+		Subsystem: "upstream",
+		Name:      "requests_total",
+		Help:      "Requests sent to the upstream by method and status code, redirects included.",
+	}, []string{"method", "code"})
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "tigerbat",
+		Subsystem: "upstream",
+		Name:      "request_duration_seconds",
+		Help:      "Time until the upstream answered with headers.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+	upstreamBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tigerbat",
+		Subsystem: "upstream",
+		Name:      "bytes_total",
+		Help:      "Object bytes fetched from the upstream.",
+	})
+	upstreamRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tigerbat",
+		Subsystem: "upstream",
+		Name:      "retries_total",
+		Help:      "Requests to the upstream sent again after a transient failure.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(upstreamRequests, upstreamDuration, upstreamBytes, upstreamRetries)
+}
+
+// observeUpstream records a request sent to the upstream at start, response
+// being nil if it failed.
+func observeUpstream(method string, response *http.Response, start time.Time) {
+	upstreamDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	code := "error"
+	if response != nil {
+		code = strconv.Itoa(response.StatusCode)
+	}
+	upstreamRequests.WithLabelValues(method, code).Inc()
+}
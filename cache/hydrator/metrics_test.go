@@ -0,0 +1,37 @@
+package hydrator
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUpstreamMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Range", "bytes 2-4/10")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte("234"))
+	}))
+	defer upstream.Close()
+	h := NewHydrator(upstream.URL, http.DefaultTransport)
+	bytes := testutil.ToFloat64(upstreamBytes)
+	partial := testutil.ToFloat64(upstreamRequests.WithLabelValues("GET", "206"))
+	notFound := testutil.ToFloat64(upstreamRequests.WithLabelValues("GET", "404"))
+
+	_, err := h.Get(context.Background(), "foo", &CacheEntry{Metadata: map[string]string{"Content-Length": "10"}}, 2, 5)
+	assert.Nil(t, err)
+	_, err = h.Get(context.Background(), "missing", &CacheEntry{Metadata: map[string]string{"Content-Length": "10"}}, 2, 5)
+	assert.NotNil(t, err)
+
+	assert.Equal(t, bytes+3, testutil.ToFloat64(upstreamBytes))
+	assert.Equal(t, partial+1, testutil.ToFloat64(upstreamRequests.WithLabelValues("GET", "206")))
+	assert.Equal(t, notFound+1, testutil.ToFloat64(upstreamRequests.WithLabelValues("GET", "404")))
+	assert.NotZero(t, testutil.CollectAndCount(upstreamDuration))
+}
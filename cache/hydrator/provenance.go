@@ -0,0 +1,77 @@
+package hydrator
+
+import (
+	"strings"
+	"sync"
+)
+
+// Tiers a block can be served from.
+const (
+	TierMemory   = "memory"
+	TierPeer     = "peer"
+	TierDisk     = "disk"
+	TierUpstream = "upstream"
+)
+
+// Provenance records where the blocks of a response were served from. Each
+// block is described by the tiers it went through, e.g. "peer=10.0.0.3:8000,disk"
+// for a block a peer read from its disk. Only the first read of a block counts.
+type Provenance struct {
+	// RequestID is passed on to peers and the upstream.
+	RequestID string
+
+	lock          sync.Mutex
+	blocks        map[int64]bool
+	paths         []string
+	upstreamBytes int64
+}
+
+func (p *Provenance) Add(block int64, path string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.blocks == nil {
+		p.blocks = make(map[int64]bool)
+	}
+	if p.blocks[block] {
+		return
+	}
+	p.blocks[block] = true
+	for _, seen := range p.paths {
+		if seen == path {
+			return
+		}
+	}
+	p.paths = append(p.paths, path)
+}
+
+// FromUpstream reports whether any block had to be fetched from the upstream.
+func (p *Provenance) FromUpstream() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, path := range p.paths {
+		if strings.HasSuffix(path, TierUpstream) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddUpstreamBytes counts bytes fetched from the upstream for the response,
+// by this node or by a peer.
+func (p *Provenance) AddUpstreamBytes(n int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.upstreamBytes += n
+}
+
+func (p *Provenance) UpstreamBytes() int64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.upstreamBytes
+}
+
+func (p *Provenance) String() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return strings.Join(p.paths, "; ")
+}
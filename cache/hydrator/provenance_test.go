@@ -0,0 +1,39 @@
+package hydrator
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestProvenance(t *testing.T) {
+	tests := []struct {
+		name     string
+		blocks   map[int64]string
+		tiers    string
+		upstream bool
+	}{
+		{"nothing read", nil, "", false},
+		{"memory", map[int64]string{0: TierMemory}, "memory", false},
+		{"peer disk", map[int64]string{0: "peer=10.0.0.3:8000,disk"}, "peer=10.0.0.3:8000,disk", false},
+		{"peer upstream", map[int64]string{0: "peer=10.0.0.3:8000,upstream"}, "peer=10.0.0.3:8000,upstream", true},
+		{"same path once", map[int64]string{0: TierDisk, 1: TierDisk}, "disk", false},
+	}
+	for _, test := range tests {
+		provenance := &Provenance{}
+		for block, path := range test.blocks {
+			provenance.Add(block, path)
+		}
+		assert.Equal(t, test.tiers, provenance.String(), test.name)
+		assert.Equal(t, test.upstream, provenance.FromUpstream(), test.name)
+	}
+
+	// only the first read of a block counts
+	provenance := &Provenance{}
+	provenance.Add(0, TierMemory)
+	provenance.Add(0, TierUpstream)
+	provenance.Add(1, TierUpstream)
+	assert.Equal(t, "memory; upstream", provenance.String())
+	provenance.AddUpstreamBytes(10)
+	provenance.AddUpstreamBytes(5)
+	assert.Equal(t, int64(15), provenance.UpstreamBytes())
+}
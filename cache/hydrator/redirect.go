@@ -0,0 +1,129 @@
+package hydrator
+
+import (
+	"errors"
+	"github.com/pquerna/cachecontrol/cacheobject"
+	"net/http"
+	"time"
+)
+
+const maxRedirects = 10
+
+// defaultLocationTTL is how long a redirect is followed when the upstream
+// doesn't say how long it is good for.
+const defaultLocationTTL = 60 * time.Second
+
+// Location is where the bytes of an object are fetched from when the
+// upstream redirects, e.g. to object storage. Signed locations expire, so a
+// location is only used until Expires.
+type Location struct {
+	Url     string
+	Expires time.Time
+}
+
+func (location *Location) valid() bool {
+	return location != nil && time.Now().Before(location.Expires)
+}
+
+// do sends request, following redirects itself so that the final location
+// can be remembered. The returned location is nil if there was no redirect.
+func do(client *http.Client, request *http.Request) (*http.Response, *Location, error) {
+	noFollow := *client
+	noFollow.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	var location *Location
+	for redirects := 0; ; redirects++ {
+		start := time.Now()
+		response, err := noFollow.Do(request)
+		observeUpstream(request.Method, response, start)
+		if err != nil {
+			return nil, nil, err
+		}
+		target := response.Header.Get("Location")
+		if !isRedirect(response.StatusCode) || target == "" {
+			return response, location, nil
+		}
+		response.Body.Close()
+		if redirects == maxRedirects {
+			return nil, nil, errors.New("Too many redirects: " + request.URL.String())
+		}
+
+		next, err := request.URL.Parse(target)
+		if err != nil {
+			return nil, nil, err
+		}
+		// the chain is only good for as long as its shortest lived hop
+		expires := redirectExpiration(response)
+		if location != nil && location.Expires.Before(expires) {
+			expires = location.Expires
+		}
+		location = &Location{
+			Url:     next.String(),
+			Expires: expires,
+		}
+
+		redirected, err := http.NewRequest(request.Method, location.Url, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		redirected = redirected.WithContext(request.Context())
+		for k, v := range request.Header {
+			redirected.Header[k] = v
+		}
+		request = redirected
+	}
+}
+
+func isRedirect(statusCode int) bool {
+	switch statusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// redirectExpiration returns how long the target of a redirect may be used.
+// Redirectors usually forbid caching the redirect itself, which doesn't
+// matter here: only the target is reused, and only for a short while.
+func redirectExpiration(response *http.Response) time.Time {
+	now := time.Now()
+	resDir, err := cacheobject.ParseResponseCacheControl(response.Header.Get("Cache-Control"))
+	if err == nil && resDir.MaxAge > 0 {
+		return now.Add(time.Duration(resDir.MaxAge) * time.Second)
+	}
+	if expires, err := http.ParseTime(response.Header.Get("Expires")); err == nil && expires.After(now) {
+		return expires
+	}
+	return now.Add(defaultLocationTTL)
+}
+
+// location returns where to fetch key from: a location refreshed by this
+// hydrator, else the one recorded with the metadata, as long as they are
+// valid. nil means the upstream url itself.
+func (h *hydratorImpl) location(key string, hint *Location) *Location {
+	h.locationsLock.Lock()
+	defer h.locationsLock.Unlock()
+	if refreshed, ok := h.locations[key]; ok {
+		if refreshed.valid() {
+			return refreshed
+		}
+		delete(h.locations, key)
+	}
+	if hint.valid() {
+		return hint
+	}
+	return nil
+}
+
+func (h *hydratorImpl) setLocation(key string, location *Location) {
+	h.locationsLock.Lock()
+	defer h.locationsLock.Unlock()
+	if location == nil {
+		delete(h.locations, key)
+		return
+	}
+	h.locations[key] = location
+}
@@ -0,0 +1,87 @@
+package hydrator
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// Requests to the upstream are attempted up to maxAttempts times, waiting
+// retryBaseDelay, doubled after every attempt up to retryMaxDelay, with
+// jitter so nodes don't retry in lockstep.
+const (
+	maxAttempts    = 4
+	retryBaseDelay = 100 * time.Millisecond
+	retryMaxDelay  = 2 * time.Second
+)
+
+// retry calls fetch until it succeeds, fails for good, runs out of attempts
+// or ctx is done. Failures to reach the upstream come back as UpstreamError.
+func retry(ctx context.Context, fetch func() error) error {
+	delay := retryBaseDelay
+	for attempt := 1; ; attempt++ {
+		err := fetch()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !transient(err) || attempt == maxAttempts {
+			return upstreamError(err)
+		}
+		upstreamRetries.Inc()
+		jittered := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		select {
+		case <-time.After(jittered):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+		if delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+	}
+}
+
+// transient reports whether err may go away when the request is sent again.
+func transient(err error) bool {
+	var statusErr StatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	// timeouts, connections refused or dropped and bodies cut short, not
+	// certificates or urls that won't do
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// upstreamError types the errors of requests that never got a complete
+// answer.
+func upstreamError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return UpstreamError{Err: err, Timeout: netErr.Timeout()}
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return UpstreamError{Err: err}
+	}
+	return err
+}
@@ -0,0 +1,48 @@
+package hydrator
+
+import (
+	"crypto/x509"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestTransient(t *testing.T) {
+	urlError := func(err error) error {
+		return &url.Error{Op: "Get", URL: "http://upstream/foo", Err: err}
+	}
+	tests := []struct {
+		err       error
+		transient bool
+	}{
+		{StatusError{StatusCode: 503}, true},
+		{StatusError{StatusCode: 429}, true},
+		{StatusError{StatusCode: 404}, false},
+		{urlError(timeoutError{}), true},
+		{urlError(&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), true},
+		{urlError(&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), true},
+		{urlError(io.EOF), true},
+		{io.ErrUnexpectedEOF, true},
+		{urlError(x509.UnknownAuthorityError{}), false},
+		{urlError(errors.New("stopped after 10 redirects")), false},
+		{urlError(errors.New("unsupported protocol scheme")), false},
+		{&net.DNSError{Err: "no such host", Name: "upstream"}, false},
+		{context.Canceled, false},
+		{RangeError{Reason: "the body is longer than the range"}, false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.transient, transient(test.err), test.err.Error())
+	}
+}
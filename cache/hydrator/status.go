@@ -0,0 +1,18 @@
+package hydrator
+
+// Roles a node can have in the cluster.
+const (
+	RoleJoining = "joining"
+	RoleMember  = "member"
+	RoleLeaving = "leaving"
+)
+
+// Status describes a node and whether it is ready to serve requests.
+// Checks maps every readiness check to "ok" or the reason it failed.
+type Status struct {
+	Self   string            `json:"self"`
+	Role   string            `json:"role"`
+	Peers  []string          `json:"peers"`
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
@@ -0,0 +1,33 @@
+package hydrator
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// parseTags returns the tags the upstream labeled an object with, from
+// Surrogate-Key (space separated) and Cache-Tag (comma separated).
+func parseTags(header http.Header) []string {
+	seen := make(map[string]bool)
+	var tags []string
+	add := func(tag string) {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	for _, value := range header["Surrogate-Key"] {
+		for _, tag := range strings.Fields(value) {
+			add(tag)
+		}
+	}
+	for _, value := range header["Cache-Tag"] {
+		for _, tag := range strings.Split(value, ",") {
+			add(tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
@@ -0,0 +1,90 @@
+package hydrator
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// TransportConfig tunes the connections to an upstream. Zero timeouts fall
+// back to the defaults, a zero MaxConnsPerHost means no limit.
+type TransportConfig struct {
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+
+	HTTP2 bool
+
+	// VerifyTLS turns on certificate verification against the system's
+	// CAs. Certificates are always verified against the CAs in CAFile if
+	// it is set. CertFile and KeyFile are the client certificate presented
+	// to the upstream, if any.
+	VerifyTLS bool
+	CAFile    string
+	CertFile  string
+	KeyFile   string
+}
+
+// Default timeouts of the upstream transport.
+const (
+	DefaultIdleConnTimeout       = 90 * time.Second
+	DefaultDialTimeout           = 10 * time.Second
+	DefaultTLSHandshakeTimeout   = 10 * time.Second
+	DefaultResponseHeaderTimeout = 30 * time.Second
+)
+
+// NewTransport returns a transport to share between everything talking to
+// the upstream, so connections are kept alive and reused.
+func NewTransport(config TransportConfig) (*http.Transport, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: !config.VerifyTLS && config.CAFile == "",
+	}
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates found in " + config.CAFile)
+		}
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   orDefault(config.DialTimeout, DefaultDialTimeout),
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   orDefault(config.TLSHandshakeTimeout, DefaultTLSHandshakeTimeout),
+		ResponseHeaderTimeout: orDefault(config.ResponseHeaderTimeout, DefaultResponseHeaderTimeout),
+		IdleConnTimeout:       orDefault(config.IdleConnTimeout, DefaultIdleConnTimeout),
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       config.MaxConnsPerHost,
+		ForceAttemptHTTP2:     config.HTTP2,
+	}, nil
+}
+
+func orDefault(value, defaultValue time.Duration) time.Duration {
+	if value <= 0 {
+		return defaultValue
+	}
+	return value
+}
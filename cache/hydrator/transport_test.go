@@ -0,0 +1,60 @@
+package hydrator
+
+import (
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewTransport(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	dir, err := ioutil.TempDir("", "transport")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	assert.Nil(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0600))
+	emptyFile := filepath.Join(dir, "empty.pem")
+	assert.Nil(t, ioutil.WriteFile(emptyFile, nil, 0600))
+
+	tests := []struct {
+		name     string
+		config   TransportConfig
+		insecure bool
+		reaches  bool
+	}{
+		{"unverified by default", TransportConfig{}, true, true},
+		{"verified against the system's CAs", TransportConfig{VerifyTLS: true}, false, false},
+		{"verified against the CA file", TransportConfig{CAFile: caFile}, false, true},
+		{"verified against the CA file when asked", TransportConfig{VerifyTLS: true, CAFile: caFile}, false, true},
+	}
+	for _, test := range tests {
+		transport, err := NewTransport(test.config)
+		if !assert.Nil(t, err, test.name) {
+			continue
+		}
+		assert.Equal(t, test.insecure, transport.TLSClientConfig.InsecureSkipVerify, test.name)
+		assert.Equal(t, DefaultResponseHeaderTimeout, transport.ResponseHeaderTimeout, test.name)
+		assert.Equal(t, DefaultTLSHandshakeTimeout, transport.TLSHandshakeTimeout, test.name)
+
+		client := http.Client{Transport: transport, Timeout: 5 * time.Second}
+		response, err := client.Get(upstream.URL)
+		if err == nil {
+			response.Body.Close()
+		}
+		assert.Equal(t, test.reaches, err == nil, test.name)
+	}
+
+	_, err = NewTransport(TransportConfig{CAFile: emptyFile})
+	assert.NotNil(t, err)
+	_, err = NewTransport(TransportConfig{CAFile: filepath.Join(dir, "missing.pem")})
+	assert.NotNil(t, err)
+	_, err = NewTransport(TransportConfig{CertFile: filepath.Join(dir, "missing.pem")})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,91 @@
+package hydrator
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// notForwarded are client headers never sent upstream when retrieving
+// metadata. They are hop-by-hop, handled by the cache itself, or
+// credentials that must not be reused for other clients.
+var notForwarded = map[string]bool{
+	"Authorization":       true,
+	"Cache-Control":       true,
+	"Connection":          true,
+	"Content-Length":      true,
+	"Cookie":              true,
+	"Host":                true,
+	"If-Match":            true,
+	"If-Modified-Since":   true,
+	"If-None-Match":       true,
+	"If-Range":            true,
+	"If-Unmodified-Since": true,
+	"Keep-Alive":          true,
+	"Pragma":              true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Range":               true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// forwardHeaders copies the client headers the upstream may select a
+// representation on.
+func forwardHeaders(dest http.Header, clientHeaders http.Header) {
+	for k, v := range clientHeaders {
+		if !notForwarded[http.CanonicalHeaderKey(k)] {
+			dest[k] = v
+		}
+	}
+}
+
+// parseVary returns the sorted, canonical header names listed in Vary.
+// A Vary of "*" is returned as is.
+func parseVary(header http.Header) []string {
+	seen := make(map[string]bool)
+	var vary []string
+	for _, value := range header[http.CanonicalHeaderKey("Vary")] {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if name != "*" {
+				name = http.CanonicalHeaderKey(name)
+			}
+			if !seen[name] {
+				seen[name] = true
+				vary = append(vary, name)
+			}
+		}
+	}
+	sort.Strings(vary)
+	return vary
+}
+
+// Variant returns the values of the headers named in vary, which select the
+// representation a client gets.
+func Variant(vary []string, clientHeaders http.Header) map[string]string {
+	if len(vary) == 0 {
+		return nil
+	}
+	variant := make(map[string]string)
+	for _, name := range vary {
+		variant[name] = strings.Join(clientHeaders[http.CanonicalHeaderKey(name)], ", ")
+	}
+	return variant
+}
+
+// VariesOnAll reports whether the response varies on something other than
+// request headers, i.e. Vary: *.
+func (entry *CacheEntry) VariesOnAll() bool {
+	for _, name := range entry.Vary {
+		if name == "*" {
+			return true
+		}
+	}
+	return false
+}
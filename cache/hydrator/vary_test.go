@@ -0,0 +1,72 @@
+package hydrator
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestParseVary(t *testing.T) {
+	tests := []struct {
+		vary []string
+		want []string
+	}{
+		{nil, nil},
+		{[]string{""}, nil},
+		{[]string{"accept-encoding"}, []string{"Accept-Encoding"}},
+		{[]string{"Accept-Language, accept-encoding"}, []string{"Accept-Encoding", "Accept-Language"}},
+		{[]string{"Accept-Encoding", "accept-encoding,,Origin "}, []string{"Accept-Encoding", "Origin"}},
+		{[]string{"Origin, *"}, []string{"*", "Origin"}},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		for _, value := range test.vary {
+			header.Add("Vary", value)
+		}
+		assert.Equal(t, test.want, parseVary(header), "%q", test.vary)
+	}
+}
+
+func TestVariant(t *testing.T) {
+	clientHeaders := http.Header{
+		"Accept-Encoding": {"gzip", "br"},
+		"Origin":          {"http://a"},
+	}
+	tests := []struct {
+		vary []string
+		want map[string]string
+	}{
+		{nil, nil},
+		{[]string{"Accept-Encoding"}, map[string]string{"Accept-Encoding": "gzip, br"}},
+		{[]string{"Accept-Encoding", "Origin"}, map[string]string{"Accept-Encoding": "gzip, br", "Origin": "http://a"}},
+		// a missing header selects a variant too
+		{[]string{"Accept-Language"}, map[string]string{"Accept-Language": ""}},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, Variant(test.vary, clientHeaders), "%q", test.vary)
+	}
+}
+
+func TestVariesOnAll(t *testing.T) {
+	assert.False(t, (&CacheEntry{}).VariesOnAll())
+	assert.False(t, (&CacheEntry{Vary: []string{"Accept-Encoding"}}).VariesOnAll())
+	assert.True(t, (&CacheEntry{Vary: []string{"*", "Origin"}}).VariesOnAll())
+}
+
+func TestForwardHeaders(t *testing.T) {
+	dest := http.Header{"User-Agent": {"tigerbat"}}
+	forwardHeaders(dest, http.Header{
+		"Accept-Encoding": {"gzip"},
+		"Authorization":   {"Bearer secret"},
+		"Cookie":          {"session=1"},
+		"Range":           {"bytes=0-1"},
+		"If-None-Match":   {`"v1"`},
+		"Connection":      {"close"},
+		"X-Custom":        {"a", "b"},
+	})
+	assert.Equal(t, http.Header{
+		"User-Agent":      {"tigerbat"},
+		"Accept-Encoding": {"gzip"},
+		"X-Custom":        {"a", "b"},
+	}, dest)
+}
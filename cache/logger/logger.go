@@ -0,0 +1,77 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Level is the minimum severity of the messages that are written.
+type Level int32
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses one of debug, info, warn or error.
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return Info, errors.New("Unknown log level " + name)
+}
+
+var level = int32(Info)
+
+// SetLevel changes the level, it is safe to call while logging.
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+func GetLevel() Level {
+	return Level(atomic.LoadInt32(&level))
+}
+
+// Enabled reports whether messages at l are written, to skip building
+// expensive messages.
+func Enabled(l Level) bool {
+	return l >= GetLevel()
+}
+
+func Debugln(v ...interface{}) {
+	output(Debug, v)
+}
+
+func Infoln(v ...interface{}) {
+	output(Info, v)
+}
+
+func Warnln(v ...interface{}) {
+	output(Warn, v)
+}
+
+func Errorln(v ...interface{}) {
+	output(Error, v)
+}
+
+func output(l Level, v []interface{}) {
+	if Enabled(l) {
+		log.Output(3, strings.ToUpper(l.String())+" "+fmt.Sprintln(v...))
+	}
+}
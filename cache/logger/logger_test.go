@@ -0,0 +1,34 @@
+package logger
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestLevels(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	defer SetLevel(GetLevel())
+
+	SetLevel(Warn)
+	Infoln("hidden")
+	Warnln("shown")
+	assert.NotContains(t, out.String(), "hidden")
+	assert.Contains(t, out.String(), "WARN shown")
+
+	SetLevel(Debug)
+	Debugln("now shown")
+	assert.Contains(t, out.String(), "DEBUG now shown")
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("DEBUG")
+	assert.Nil(t, err)
+	assert.Equal(t, Debug, level)
+	_, err = ParseLevel("verbose")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,61 @@
+package gcache
+
+import (
+	"errors"
+	"github.com/fkautz/tigerbat/cache/hydrator"
+	"github.com/pquerna/cachecontrol/cacheobject"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrNotCached is returned when a client asked for only-if-cached and the
+// object can't be served without contacting the upstream.
+var ErrNotCached = errors.New("Not cached")
+
+// clientDirectives parses the Cache-Control header of a client request.
+// Pragma: no-cache is only honored without a Cache-Control header (RFC 7234
+// section 5.4). Unparseable directives are ignored.
+func clientDirectives(clientHeaders http.Header) *cacheobject.RequestCacheDirectives {
+	directives, err := cacheobject.ParseRequestCacheControl(clientHeaders.Get("Cache-Control"))
+	if err != nil {
+		directives, _ = cacheobject.ParseRequestCacheControl("")
+	}
+	if clientHeaders.Get("Cache-Control") == "" && strings.Contains(strings.ToLower(clientHeaders.Get("Pragma")), "no-cache") {
+		directives.NoCache = true
+	}
+	return directives
+}
+
+// wantsRevalidation reports whether the client won't accept the entry without
+// it being revalidated first, either by asking for it outright or because
+// the entry is too old or too close to expiring for it.
+func wantsRevalidation(directives *cacheobject.RequestCacheDirectives, cacheEntry *hydrator.CacheEntry, now time.Time) bool {
+	if directives.NoCache || directives.MaxAge == 0 {
+		return true
+	}
+	if directives.MaxAge > 0 {
+		retrieved, err := http.ParseTime(cacheEntry.Metadata["X-Cache-Date-Retrieved"])
+		if err == nil && now.Sub(retrieved) > time.Duration(directives.MaxAge)*time.Second {
+			return true
+		}
+	}
+	if directives.MinFresh > 0 {
+		if cacheEntry.ObjectResults.OutExpirationTime.Sub(now) < time.Duration(directives.MinFresh)*time.Second {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsStale reports whether the client is willing to take the entry
+// although it expired staleness ago.
+func acceptsStale(directives *cacheobject.RequestCacheDirectives, cacheEntry *hydrator.CacheEntry, staleness time.Duration) bool {
+	if cacheEntry.MustRevalidate {
+		return false
+	}
+	if directives.MaxStaleSet {
+		return true
+	}
+	return directives.MaxStale >= 0 && staleness <= time.Duration(directives.MaxStale)*time.Second
+}
@@ -0,0 +1,103 @@
+package gcache
+
+import (
+	"github.com/fkautz/tigerbat/cache/hydrator"
+	"github.com/pquerna/cachecontrol/cacheobject"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"golang.org/x/net/context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWantsRevalidation(t *testing.T) {
+	now := time.Now()
+	cacheEntry := &hydrator.CacheEntry{
+		ObjectResults: &cacheobject.ObjectResults{OutExpirationTime: now.Add(time.Minute)},
+		Metadata:      map[string]string{"X-Cache-Date-Retrieved": now.Add(-time.Hour).UTC().Format(http.TimeFormat)},
+	}
+	tests := []struct {
+		header http.Header
+		wants  bool
+	}{
+		{http.Header{}, false},
+		{http.Header{"Cache-Control": {"no-cache"}}, true},
+		{http.Header{"Cache-Control": {"max-age=0"}}, true},
+		{http.Header{"Pragma": {"no-cache"}}, true},
+		// Pragma is ignored when Cache-Control is given
+		{http.Header{"Cache-Control": {"max-stale"}, "Pragma": {"no-cache"}}, false},
+		{http.Header{"Cache-Control": {"max-age=1800"}}, true},
+		{http.Header{"Cache-Control": {"max-age=7200"}}, false},
+		{http.Header{"Cache-Control": {"min-fresh=30"}}, false},
+		{http.Header{"Cache-Control": {"min-fresh=120"}}, true},
+		{http.Header{"Cache-Control": {"max-age=garbage"}}, false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.wants, wantsRevalidation(clientDirectives(test.header), cacheEntry, now), "%v", test.header)
+	}
+}
+
+func TestAcceptsStale(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		must         bool
+		staleness    time.Duration
+		accepts      bool
+	}{
+		{"", false, time.Second, false},
+		{"max-stale", false, time.Hour, true},
+		{"max-stale=60", false, 30 * time.Second, true},
+		{"max-stale=60", false, 2 * time.Minute, false},
+		{"max-stale", true, time.Second, false},
+	}
+	for _, test := range tests {
+		cacheEntry := &hydrator.CacheEntry{MustRevalidate: test.must}
+		directives := clientDirectives(http.Header{"Cache-Control": {test.cacheControl}})
+		assert.Equal(t, test.accepts, acceptsStale(directives, cacheEntry, test.staleness), test.cacheControl)
+	}
+}
+
+func TestGetMetadataClientDirectives(t *testing.T) {
+	tests := []struct {
+		name          string
+		cacheControl  string
+		expired       time.Duration
+		ignore        bool
+		revalidations int
+		err           error
+		warning       string
+	}{
+		{"fresh", "", -time.Hour, false, 0, nil, ""},
+		{"no-cache", "no-cache", -time.Hour, false, 1, nil, ""},
+		{"no-cache ignored", "no-cache", -time.Hour, true, 0, nil, ""},
+		{"min-fresh", "min-fresh=7200", -time.Hour, false, 1, nil, ""},
+		{"max-stale", "max-stale=60", 30 * time.Second, false, 1, nil, hydrator.WarningResponseIsStale},
+		{"only-if-cached expired", "only-if-cached", time.Minute, false, 0, ErrNotCached, ""},
+		{"only-if-cached fresh", "only-if-cached", -time.Hour, false, 0, nil, ""},
+	}
+	for _, test := range tests {
+		upstream := new(testHydrator)
+		upstream.On("Revalidate", "foo", mock.Anything).Return(expiredEntry(-2*time.Hour), nil)
+		mc := metadataTestCache(upstream, expiredEntry(test.expired))
+		mc.ignoreClientRevalidation = test.ignore
+
+		cacheEntry, err := mc.GetMetadata(context.Background(), "foo", http.Header{"Cache-Control": {test.cacheControl}})
+		assert.Equal(t, test.err, err, test.name)
+		if err == nil {
+			assert.Equal(t, test.warning, cacheEntry.Warning, test.name)
+		}
+		assert.Eventually(t, func() bool {
+			mc.revalidatingLock.Lock()
+			defer mc.revalidatingLock.Unlock()
+			return len(mc.revalidating) == 0
+		}, time.Second, time.Millisecond, test.name)
+		upstream.AssertNumberOfCalls(t, "Revalidate", test.revalidations)
+	}
+
+	upstream := new(testHydrator)
+	mc := metadataTestCache(upstream, nil)
+	_, err := mc.GetMetadata(context.Background(), "foo", http.Header{"Cache-Control": {"only-if-cached"}})
+	assert.Equal(t, ErrNotCached, err)
+	upstream.AssertNotCalled(t, "GetMetadata", "foo", mock.Anything)
+}
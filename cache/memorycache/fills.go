@@ -0,0 +1,84 @@
+package gcache
+
+import (
+	"golang.org/x/net/context"
+	"sync"
+)
+
+// fills tracks the requests waiting for each block. groupcache loads a block
+// once for everyone asking for it at the same time, with the context of
+// whoever asked first, so loads get a context of their own that is only
+// canceled when every request waiting for the block is gone.
+type fillTracker struct {
+	lock  sync.Mutex
+	fills map[string]*fill
+}
+
+type fill struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	// waiting counts requests still interested in the block, joined those
+	// that haven't returned from the load yet.
+	waiting int
+	joined  int
+}
+
+var fills = &fillTracker{fills: make(map[string]*fill)}
+
+// wait registers a request for key. The returned context is to be used for
+// loading the block, done must be called once the load returned.
+func (t *fillTracker) wait(ctx context.Context, key string) (context.Context, func()) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	t.lock.Lock()
+	f := t.fills[key]
+	if f == nil || f.ctx.Err() != nil {
+		// an abandoned load is left to the requests still returning from it
+		f = &fill{}
+		f.ctx, f.cancel = context.WithCancel(context.Background())
+		t.fills[key] = f
+	}
+	f.waiting++
+	f.joined++
+	t.lock.Unlock()
+
+	left := false
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			t.lock.Lock()
+			if !left {
+				left = true
+				t.leave(f)
+			}
+			t.lock.Unlock()
+		case <-stop:
+		}
+	}()
+
+	return f.ctx, func() {
+		close(stop)
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		if !left {
+			left = true
+			t.leave(f)
+		}
+		f.joined--
+		if f.joined == 0 {
+			f.cancel()
+			if t.fills[key] == f {
+				delete(t.fills, key)
+			}
+		}
+	}
+}
+
+func (t *fillTracker) leave(f *fill) {
+	f.waiting--
+	if f.waiting == 0 {
+		f.cancel()
+	}
+}
@@ -0,0 +1,84 @@
+package gcache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFillOutlivesFirstWaiter(t *testing.T) {
+	tracker := &fillTracker{fills: make(map[string]*fill)}
+	first, cancelFirst := context.WithCancel(context.Background())
+	second, cancelSecond := context.WithCancel(context.Background())
+
+	loadCtx, firstDone := tracker.wait(first, "block")
+	sameCtx, secondDone := tracker.wait(second, "block")
+	assert.Equal(t, loadCtx, sameCtx)
+
+	// the block keeps loading while another request waits for it
+	cancelFirst()
+	firstDone()
+	assert.Nil(t, loadCtx.Err())
+
+	// and is abandoned once the last one goes away
+	cancelSecond()
+	<-loadCtx.Done()
+	secondDone()
+	assert.Empty(t, tracker.fills)
+}
+
+func TestFillAbandonedIsStartedAgain(t *testing.T) {
+	tracker := &fillTracker{fills: make(map[string]*fill)}
+	gone, cancel := context.WithCancel(context.Background())
+	abandoned, goneDone := tracker.wait(gone, "block")
+	cancel()
+	<-abandoned.Done()
+
+	// the load is still returning, a new request gets a load of its own
+	loadCtx, done := tracker.wait(context.Background(), "block")
+	assert.Nil(t, loadCtx.Err())
+	goneDone()
+	assert.Nil(t, loadCtx.Err())
+	done()
+	assert.NotNil(t, loadCtx.Err())
+}
+
+func TestPeerAbandonedLoadIsRetried(t *testing.T) {
+	var requests int32
+	peer := httptest.NewServer(reportTiers(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// as groupcache reports a load canceled for everyone
+			http.Error(w, context.Canceled.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("block"))
+	})))
+	defer peer.Close()
+
+	request, _ := http.NewRequest("GET", peer.URL+peerBasePath+"group/key", nil)
+	response, err := peerTransport{ctx: context.Background()}.RoundTrip(request)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	response.Body.Close()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestPeerFailureIsNotRetried(t *testing.T) {
+	var requests int32
+	peer := httptest.NewServer(reportTiers(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "Upstream failed", http.StatusInternalServerError)
+	})))
+	defer peer.Close()
+
+	request, _ := http.NewRequest("GET", peer.URL+peerBasePath+"group/key", nil)
+	response, err := peerTransport{ctx: context.Background()}.RoundTrip(request)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusInternalServerError, response.StatusCode)
+	assert.Empty(t, response.Header.Get(abandonedHeader))
+	response.Body.Close()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
@@ -1,10 +1,15 @@
 package gcache
 
 import (
-	"encoding/json"
 	"errors"
+	"github.com/fkautz/tigerbat/cache/hydrator"
+	"github.com/fkautz/tigerbat/cache/logger"
+	"github.com/fkautz/tigerbat/cache/sizereaderat"
 	"github.com/golang/groupcache"
+	"golang.org/x/net/context"
 	"io"
+	"strconv"
+	"sync/atomic"
 )
 
 type lazyReaderAt struct {
@@ -12,30 +17,219 @@ type lazyReaderAt struct {
 	size      int64
 	groupName string
 	ctx       cacheContext
+
+	provenance *hydrator.Provenance
+	// invalidate drops the metadata when the object changed upstream
+	invalidate func(url string) error
+	// noRanges marks the object to be fetched whole when its upstream
+	// ignored a Range request, whole is then set for the other blocks
+	noRanges func()
+	whole    *int32
 }
 
 func (reader lazyReaderAt) ReadAt(p []byte, offset int64) (int, error) {
 	//key := reader.request.key + "-" + strconv.Itoa(int(reader.request.block))
 
-	jsonDataRequest, err := json.Marshal(reader.request)
+	var streamed int
+	byteView, fromStream, err := reader.load(func(ctx context.Context, fill *streamFill) error {
+		var err error
+		streamed, err = fill.readAt(ctx, p, offset)
+		return err
+	})
 	if err != nil {
 		return 0, err
 	}
-	key := "data/" + string(jsonDataRequest)
-	var byteView groupcache.ByteView
-	err = groupcache.GetGroup(reader.groupName).Get(reader.ctx, key, groupcache.ByteViewSink(&byteView))
-	if err != nil {
-		return 0, err
+	if fromStream {
+		return streamed, nil
 	}
 	n := byteView.SliceFrom(int(offset)).Copy(p)
 	//n := copy(p, byteView.ByteSlice()[offset:])
 	return int(n), err
 }
 
+// WriteRangeTo writes n bytes of the block from offset on to w. While this
+// node loads the block from the upstream they are written as they arrive.
+func (reader lazyReaderAt) WriteRangeTo(w io.Writer, offset, n int64) (int64, error) {
+	out := &recordingWriter{Writer: w}
+	var written int64
+	byteView, fromStream, err := reader.load(func(ctx context.Context, fill *streamFill) error {
+		var err error
+		written, err = fill.writeTo(ctx, out, offset, offset+n)
+		if out.err != nil {
+			// the client is gone, there is nothing to fall back to
+			return nil
+		}
+		return err
+	})
+	if out.err != nil {
+		return written, out.err
+	}
+	if err != nil {
+		return written, err
+	}
+	if fromStream {
+		return written, nil
+	}
+	rest, err := byteView.Slice(int(offset+written), int(offset+n)).WriteTo(w)
+	return written + rest, err
+}
+
+// recordingWriter remembers the error writing failed with.
+type recordingWriter struct {
+	io.Writer
+	err error
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// load returns the block. While this node loads it from the upstream, the
+// fill is handed to stream instead, to read what it needs as it arrives;
+// fromStream reports whether stream got it all.
+func (reader lazyReaderAt) load(stream func(ctx context.Context, fill *streamFill) error) (byteView groupcache.ByteView, fromStream bool, err error) {
+	ctx := reader.ctx.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	type result struct {
+		byteView groupcache.ByteView
+		err      error
+	}
+	results := make(chan result, 1)
+	go func() {
+		byteView, err := reader.fetch()
+		results <- result{byteView, err}
+	}()
+
+	key := reader.request.Key + "-" + strconv.FormatInt(reader.request.Block, 10)
+	for {
+		fill, started, stop := watchStream(key)
+		if fill != nil {
+			if err := stream(ctx, fill); err == nil {
+				if reader.provenance != nil {
+					reader.provenance.Add(reader.request.Block, hydrator.TierUpstream)
+				}
+				if fill.complete() {
+					// the load is about to return, let it count the bytes
+					<-results
+				}
+				return byteView, true, nil
+			}
+			// the load reports why the fill failed, or retries it
+			loaded := <-results
+			return loaded.byteView, false, loaded.err
+		}
+		select {
+		case loaded := <-results:
+			stop()
+			return loaded.byteView, false, loaded.err
+		case <-started:
+			stop()
+		}
+	}
+}
+
+// fetch returns the block, from whichever tier has it.
+func (reader lazyReaderAt) fetch() (groupcache.ByteView, error) {
+	var byteView groupcache.ByteView
+	ctx := reader.ctx
+	ctx.tiers = &tierPath{}
+	request := reader.request
+	var err error
+	for attempt := 0; ; attempt++ {
+		if reader.ctx.ctx != nil && reader.ctx.ctx.Err() != nil {
+			return byteView, reader.ctx.ctx.Err()
+		}
+		if reader.whole != nil && atomic.LoadInt32(reader.whole) == 1 {
+			request.Whole = true
+		}
+		var key string
+		key, err = request.groupKey()
+		if err != nil {
+			return byteView, err
+		}
+		var done func()
+		ctx.ctx, done = fills.wait(reader.ctx.ctx, reader.groupName+"/"+key)
+		err = groupcache.GetGroup(reader.groupName).Get(ctx, key, groupcache.ByteViewSink(&byteView))
+		done()
+		// we may have joined a load everyone else abandoned, try again.
+		// Peers report such loads with abandonedHeader, peerTransport asks
+		// them again.
+		if err != nil && errors.Is(err, context.Canceled) && attempt < 2 {
+			continue
+		}
+		// the upstream sent the whole object, fetch it that way from now on
+		if err != nil && errors.Is(err, hydrator.ErrRangesIgnored) && !request.Whole {
+			logger.Infoln("Upstream ignored Range, fetching whole", request.Url)
+			if reader.noRanges != nil {
+				reader.noRanges()
+			}
+			if reader.whole != nil {
+				atomic.StoreInt32(reader.whole, 1)
+			}
+			request.Whole = true
+			continue
+		}
+		break
+	}
+	if errors.Is(err, hydrator.ErrChanged) && reader.invalidate != nil {
+		logger.Infoln("Object changed upstream, invalidating", reader.request.Url)
+		if err := reader.invalidate(reader.request.Url); err != nil {
+			logger.Warnln("Unable to invalidate", reader.request.Url, err)
+		}
+	}
+	if err != nil {
+		return byteView, err
+	}
+	if reader.provenance != nil {
+		reader.provenance.Add(reader.request.Block, ctx.tiers.String())
+		reader.provenance.AddUpstreamBytes(ctx.tiers.upstreamBytes)
+	}
+	return byteView, nil
+}
+
 func (reader lazyReaderAt) Size() int64 {
 	return reader.size
 }
 
+// spoolReader reads an object of unknown length from its first block on.
+// A block shorter than the block size is the last one, complete is then
+// called with the object's length.
+type spoolReader struct {
+	part     lazyReaderAt
+	block    []byte
+	size     int64
+	done     bool
+	complete func(size int64)
+}
+
+func (reader *spoolReader) Read(p []byte) (int, error) {
+	for len(reader.block) == 0 {
+		if reader.done {
+			return 0, io.EOF
+		}
+		byteView, err := reader.part.fetch()
+		if err != nil {
+			return 0, err
+		}
+		reader.block = byteView.ByteSlice()
+		reader.size += int64(len(reader.block))
+		reader.part.request.Block++
+		if int64(len(reader.block)) < reader.part.request.BlockSize {
+			reader.done = true
+			reader.complete(reader.size)
+		}
+	}
+	n := copy(p, reader.block)
+	reader.block = reader.block[n:]
+	return n, nil
+}
+
 func NewLazyReader(reader io.ReaderAt, start, end, blockSize int64) io.ReadSeeker {
 	return &lazyReadSeeker{
 		base:      reader,
@@ -73,9 +267,12 @@ func (reader *lazyReadSeeker) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (reader *lazyReadSeeker) Read(p []byte) (int, error) {
-	if reader.pos == reader.end {
+	if reader.pos >= reader.end {
 		return 0, io.EOF
 	}
+	if int64(len(p)) > reader.end-reader.pos {
+		p = p[:reader.end-reader.pos]
+	}
 	n, err := reader.base.ReadAt(p, reader.pos)
 	reader.pos = reader.pos + int64(n)
 	return n, err
@@ -86,6 +283,11 @@ func (reader *lazyReadSeeker) Size() int64 {
 }
 
 func (reader *lazyReadSeeker) WriteTo(w io.Writer) (int64, error) {
+	if base, ok := reader.base.(sizereaderat.RangeWriterTo); ok {
+		n, err := base.WriteRangeTo(w, reader.pos, reader.end-reader.pos)
+		reader.pos += n
+		return n, err
+	}
 	var count int64 = 0
 	for reader.pos < reader.end {
 		var buf []byte
@@ -105,5 +307,5 @@ func (reader *lazyReadSeeker) WriteTo(w io.Writer) (int64, error) {
 			return count, err
 		}
 	}
-	return int64(count), io.EOF
+	return int64(count), nil
 }
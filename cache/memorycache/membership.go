@@ -0,0 +1,195 @@
+package gcache
+
+import (
+	"github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/fkautz/tigerbat/cache/logger"
+	"github.com/golang/groupcache"
+	"golang.org/x/net/context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every running node keeps a record under nodePrefix alive on a lease. A node
+// whose record goes away is dropped from the peer set right away, instead of
+// when peertracker expires the one it keeps under peersDir.
+const (
+	nodePrefix = "/tigerbat/nodes/"
+	nodeTTL    = 10
+	peersDir   = "/tigerbat/peers"
+)
+
+// membership is the peer set of this process, shared by all groups.
+var membership = struct {
+	lock    sync.RWMutex
+	self    string
+	pool    *groupcache.HTTPPool
+	server  *http.Server
+	peers   client.KeysAPI
+	client  *clientv3.Client
+	lease   clientv3.LeaseID
+	leaving bool
+
+	// peers as reported by peertracker, and the ones that left since
+	tracked []string
+	gone    map[string]bool
+}{
+	gone: make(map[string]bool),
+}
+
+// setPeers is called by peertracker with the peers it knows about.
+func setPeers(peers []string) {
+	membership.lock.Lock()
+	membership.tracked = peers
+	applyPeers()
+	membership.lock.Unlock()
+}
+
+func markGone(peer string, gone bool) {
+	membership.lock.Lock()
+	if gone {
+		membership.gone[peer] = true
+	} else {
+		delete(membership.gone, peer)
+	}
+	applyPeers()
+	membership.lock.Unlock()
+}
+
+// applyPeers hands the current peer set to groupcache. The lock must be held.
+func applyPeers() {
+	if membership.pool != nil {
+		membership.pool.Set(filterPeers()...)
+	}
+}
+
+func filterPeers() []string {
+	var peers []string
+	for _, peer := range membership.tracked {
+		if membership.gone[peer] || membership.leaving && peer == membership.self {
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func currentPeers() (string, []string, bool) {
+	membership.lock.RLock()
+	defer membership.lock.RUnlock()
+	return membership.self, filterPeers(), membership.leaving
+}
+
+// join registers this node and follows the registrations of the others.
+func join(client *clientv3.Client, self string) {
+	lease, err := client.Lease.Grant(context.Background(), nodeTTL)
+	if err != nil {
+		logger.Errorln("Unable to register node", err)
+		return
+	}
+	keepAlive, err := client.Lease.KeepAlive(context.Background(), lease.ID)
+	if err != nil {
+		logger.Errorln("Unable to register node", err)
+		return
+	}
+	go func() {
+		for range keepAlive {
+		}
+	}()
+	_, err = client.Put(context.Background(), nodePrefix+self, "", clientv3.WithLease(lease.ID))
+	if err != nil {
+		logger.Errorln("Unable to register node", err)
+		return
+	}
+
+	membership.lock.Lock()
+	membership.client = client
+	membership.lease = lease.ID
+	membership.lock.Unlock()
+
+	go func() {
+		ch := client.Watch(context.Background(), nodePrefix, clientv3.WithPrefix())
+		for response := range ch {
+			for _, event := range response.Events {
+				peer := strings.TrimPrefix(string(event.Kv.Key), nodePrefix)
+				markGone(peer, event.Type == mvccpb.DELETE)
+			}
+		}
+	}()
+}
+
+// leave hands this node's share of the objects to its peers. The node drops
+// out of every peer set, its own included, but keeps serving peers that
+// haven't noticed yet.
+func leave() error {
+	membership.lock.Lock()
+	membership.leaving = true
+	applyPeers()
+	self := membership.self
+	peers := membership.peers
+	etcd := membership.client
+	lease := membership.lease
+	membership.lock.Unlock()
+
+	if peers != nil {
+		// peertracker has no way to stop it, it refreshes the record of
+		// this node until the process exits. Peers drop the node when its
+		// lease is revoked below.
+		logger.Infoln("Peer tracker can't be stopped, removing its records")
+		if err := deregister(peers, self); err != nil {
+			logger.Warnln("Unable to remove peer record", err)
+		}
+	}
+	if etcd == nil {
+		return nil
+	}
+	_, err := etcd.Lease.Revoke(context.Background(), lease)
+	return err
+}
+
+// deregister deletes the records peertracker keeps for self, so nodes that
+// only follow peertracker drop this one too.
+func deregister(peers client.KeysAPI, self string) error {
+	response, err := peers.Get(context.Background(), peersDir, &client.GetOptions{Recursive: true})
+	if client.IsKeyNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var records []string
+	var walk func(node *client.Node)
+	walk = func(node *client.Node) {
+		if node.Dir {
+			for _, child := range node.Nodes {
+				walk(child)
+			}
+		} else if node.Value == self || strings.HasSuffix(node.Key, "/"+self) {
+			records = append(records, node.Key)
+		}
+	}
+	walk(response.Node)
+	for _, record := range records {
+		_, err := peers.Delete(context.Background(), record, nil)
+		if err != nil && !client.IsKeyNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// stopServingPeers waits up to timeout for running peer requests to finish.
+func stopServingPeers(timeout time.Duration) error {
+	membership.lock.RLock()
+	server := membership.server
+	membership.lock.RUnlock()
+	if server == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return server.Shutdown(ctx)
+}
@@ -0,0 +1,32 @@
+package gcache
+
+import (
+	"github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+type testKeys struct {
+	client.KeysAPI
+	nodes   *client.Node
+	deleted []string
+}
+
+func (k *testKeys) Get(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+	return &client.Response{Node: k.nodes}, nil
+}
+
+func (k *testKeys) Delete(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+	k.deleted = append(k.deleted, key)
+	return &client.Response{}, nil
+}
+
+func TestDeregister(t *testing.T) {
+	keys := &testKeys{nodes: &client.Node{Key: peersDir, Dir: true, Nodes: client.Nodes{
+		{Key: peersDir + "/1", Value: "http://10.0.0.1:8000"},
+		{Key: peersDir + "/2", Value: "http://10.0.0.2:8000"},
+	}}}
+	assert.Nil(t, deregister(keys, "http://10.0.0.2:8000"))
+	assert.Equal(t, []string{peersDir + "/2"}, keys.deleted)
+}
@@ -10,14 +10,19 @@ import (
 	"github.com/coreos/etcd/client"
 	"github.com/coreos/etcd/clientv3"
 	"github.com/fkautz/peertracker"
+	"github.com/fkautz/tigerbat/cache/accesslog"
 	"github.com/fkautz/tigerbat/cache/diskcache"
 	"github.com/fkautz/tigerbat/cache/hydrator"
+	"github.com/fkautz/tigerbat/cache/logger"
 	"github.com/fkautz/tigerbat/cache/sizereaderat"
 	"github.com/golang/groupcache"
+	"github.com/pquerna/cachecontrol/cacheobject"
+	"golang.org/x/net/context"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -29,6 +34,7 @@ type MetadataRequest struct {
 	Url     string
 	Key     string
 	Headers map[string]string
+	Variant map[string]string `json:",omitempty"`
 }
 
 type dataRequest struct {
@@ -36,20 +42,59 @@ type dataRequest struct {
 	Block     int64
 	Size      int64
 	BlockSize int64
+	// Whole is set for objects whose upstream ignores Range
+	Whole bool `json:",omitempty"`
+}
+
+// groupKey is the key the block is loaded under from groupcache.
+func (request dataRequest) groupKey() (string, error) {
+	jsonDataRequest, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+	if request.Whole {
+		return wholeKey(request, jsonDataRequest), nil
+	}
+	return "data/" + string(jsonDataRequest), nil
 }
 
 type cacheContext struct {
+	// ctx is canceled once nobody waits for the block anymore, see fills
+	ctx       context.Context
 	diskCache diskcache.Cache
 	hydrator  hydrator.Hydrator
+	tiers     *tierPath
+	requestID string
+	// location is where the upstream redirected to when the metadata was
+	// retrieved. It expires, so it is not part of the key; peers look it
+	// up again.
+	location *hydrator.Location
 }
 
 type memoryCache struct {
-	group     *groupcache.Group
-	diskCache diskcache.Cache
-	hydrator  hydrator.Hydrator
-	blockSize int64
-	groupName string
-	metadata  MetadataCache
+	group      *groupcache.Group
+	diskCache  diskcache.Cache
+	hydrator   hydrator.Hydrator
+	blockSize  int64
+	groupName  string
+	metadata   MetadataCache
+	staleGrace time.Duration
+
+	negativeTTL         time.Duration
+	negativeStatusCodes map[int]bool
+
+	ignoreClientRevalidation bool
+	noUpstreamRanges         bool
+	drainTimeout             time.Duration
+
+	// variant keys with a background revalidation in flight
+	revalidating     map[string]bool
+	revalidatingLock sync.Mutex
+
+	// the upstream's last answer to a ping
+	pinged   time.Time
+	pingErr  error
+	pingLock sync.Mutex
 }
 
 type Config struct {
@@ -60,9 +105,45 @@ type Config struct {
 	GroupName      string
 	PeeringAddress string
 	Etcd           []string
+
+	// StaleGracePeriod is how long expired objects may be served while
+	// revalidating or when the upstream fails, even if the upstream didn't
+	// ask for stale-while-revalidate or stale-if-error.
+	StaleGracePeriod time.Duration
+
+	// NegativeTTL is how long upstream answers with one of
+	// NegativeStatusCodes are remembered. Zero disables negative caching.
+	NegativeTTL         time.Duration
+	NegativeStatusCodes []int
+
+	// IgnoreClientRevalidation stops clients from forcing a revalidation
+	// with no-cache, max-age or min-fresh.
+	IgnoreClientRevalidation bool
+
+	// NoUpstreamRanges fetches every object whole, for upstreams that don't
+	// implement Range requests without saying so.
+	NoUpstreamRanges bool
+
+	// AccessLogFormat is the format requests from peers are logged in,
+	// see the accesslog package.
+	AccessLogFormat string
+
+	// DrainTimeout is how long running peer requests may take to finish
+	// on shutdown.
+	DrainTimeout time.Duration
 }
 
-type NotCacheable struct{}
+// Reasons to not cache an object that cacheobject doesn't know about.
+const (
+	ReasonExpiresTooSoon = "ReasonExpiresTooSoon"
+	ReasonVaryStar       = "ReasonVaryStar"
+)
+
+// NotCacheable is returned when an object must be fetched from the upstream
+// directly. Reasons lists why the object was not cached.
+type NotCacheable struct {
+	Reasons []string
+}
 
 func (_ NotCacheable) Error() string {
 	return "Not Cacheable"
@@ -76,6 +157,12 @@ type Key struct {
 	ContentLength   uint64 `json:",omitempty"`
 	ContentEncoding string `json:",omitempty"`
 
+	// required if the response varies
+	Variant map[string]string `json:",omitempty"`
+
+	// required once the url has been purged
+	Generation int64 `json:",omitempty"`
+
 	// require only first.
 	// last retrieved used as fallback
 	// if last retrieved is set, always set to time.Now() to force expiration
@@ -88,9 +175,11 @@ type Key struct {
 	LastRetrieved string `json:",omitempty"`
 }
 
-func GenerateKey(url string, headers map[string]string) ([]byte, error) {
+func GenerateKey(url string, headers map[string]string, variant map[string]string, generation int64) ([]byte, error) {
 	key := Key{
-		Url: url,
+		Url:        url,
+		Variant:    variant,
+		Generation: generation,
 	}
 
 	normalizedHeaders := make(map[string]string)
@@ -109,7 +198,7 @@ func GenerateKey(url string, headers map[string]string) ([]byte, error) {
 	}
 
 	var lastRetrieved string
-	dateString, ok := normalizedHeaders["x-date-retrieved"]
+	dateString, ok := normalizedHeaders["x-cache-date-retrieved"]
 	var lastRetrievedError error
 	if ok == true {
 		var lastRetrievedTime time.Time
@@ -121,15 +210,15 @@ func GenerateKey(url string, headers map[string]string) ([]byte, error) {
 
 	if v, ok := normalizedHeaders["etag"]; ok == true {
 		key.Etag = v
-	} else if v, ok := headers["sha512"]; ok == true {
+	} else if v, ok := normalizedHeaders["sha512"]; ok == true {
 		key.Etag = v
-	} else if v, ok := headers["sha256"]; ok == true {
+	} else if v, ok := normalizedHeaders["sha256"]; ok == true {
 		key.Etag = v
-	} else if v, ok := headers["sha1"]; ok == true {
+	} else if v, ok := normalizedHeaders["sha1"]; ok == true {
 		key.Etag = v
-	} else if v, ok := headers["content-md5"]; ok == true {
+	} else if v, ok := normalizedHeaders["content-md5"]; ok == true {
 		key.Etag = v
-	} else if v, ok := headers["last-modified"]; ok == true {
+	} else if v, ok := normalizedHeaders["last-modified"]; ok == true {
 		lastModifiedTime, err := http.ParseTime(v)
 		if err == nil {
 			key.LastModified = lastModifiedTime.UTC().String()
@@ -155,58 +244,333 @@ func GenerateKey(url string, headers map[string]string) ([]byte, error) {
 
 	return shasum[:], nil
 }
-func (mc *memoryCache) GetMetadata(url string, clientHeaders http.Header) (*hydrator.CacheEntry, error) {
-	var cacheEntry *hydrator.CacheEntry
+func (mc *memoryCache) GetMetadata(ctx context.Context, url string, clientHeaders http.Header) (*hydrator.CacheEntry, error) {
+	directives := clientDirectives(clientHeaders)
 	cacheEntry, foundMetadata := mc.metadata.Get(url, clientHeaders)
-
-	var err error
 	if !foundMetadata {
-		cacheEntry, err = mc.hydrator.GetMetadata(url)
-		if err != nil {
-			return nil, err
+		metadataLookups.WithLabelValues("miss").Inc()
+		if directives.OnlyIfCached {
+			return nil, ErrNotCached
 		}
+		return mc.fetchMetadata(ctx, url, clientHeaders, nil)
+	}
 
-		if len(cacheEntry.ObjectResults.OutReasons) > 0 {
-			return nil, NotCacheable{}
+	now := time.Now()
+	expiration := cacheEntry.ObjectResults.OutExpirationTime
+	if cacheEntry.StatusCode != 0 {
+		// negative entries are never served stale
+		if now.Before(expiration) {
+			metadataLookups.WithLabelValues("hit").Inc()
+			return nil, hydrator.StatusError{StatusCode: cacheEntry.StatusCode}
+		}
+		metadataLookups.WithLabelValues("miss").Inc()
+		if directives.OnlyIfCached {
+			return nil, ErrNotCached
 		}
+		return mc.fetchMetadata(ctx, url, clientHeaders, nil)
+	}
 
-		//now := time.Now()
-		//exp := cacheEntry.ObjectResults.OutExpirationTime
-		//log.Println("Now:", now)
-		//log.Println("Exp:", exp)
-		if cacheEntry.ObjectResults.OutExpirationTime.Before(time.Now().Add(60 * time.Second)) {
-			//log.Println("SKIP")
-			return nil, NotCacheable{}
-		} else if v, ok := cacheEntry.Metadata["Accept-Ranges"]; ok == true {
-			if strings.ToLower(string(v[0])) == "none" {
-				return nil, NotCacheable{}
-			}
-		} else {
-			//log.Println("CACHE")
+	forced := !mc.ignoreClientRevalidation && wantsRevalidation(directives, cacheEntry, now)
+	if now.Before(expiration) && !forced {
+		metadataLookups.WithLabelValues("hit").Inc()
+		cacheEntry.Hit = true
+		return cacheEntry, nil
+	}
+
+	// expired, serve it stale if we may and revalidate in the background
+	staleness := now.Sub(expiration)
+	if !forced && (staleness < cacheEntry.StaleWindow(cacheEntry.StaleWhileRevalidate, mc.staleGrace) || acceptsStale(directives, cacheEntry, staleness)) {
+		metadataLookups.WithLabelValues("stale").Inc()
+		mc.revalidate(url, cacheEntry)
+		staleEntry := *cacheEntry
+		staleEntry.Warning = hydrator.WarningResponseIsStale
+		staleEntry.Hit = true
+		return &staleEntry, nil
+	}
+
+	metadataLookups.WithLabelValues("miss").Inc()
+	if directives.OnlyIfCached {
+		return nil, ErrNotCached
+	}
+	freshEntry, err := mc.fetchMetadata(ctx, url, clientHeaders, cacheEntry)
+	if err != nil {
+		if isUpstreamFailure(err) && staleness < cacheEntry.StaleWindow(cacheEntry.StaleIfError, mc.staleGrace) {
+			logger.Debugln("Serving stale", url, err)
+			cacheEntry.Warning = hydrator.WarningRevalidationFailed
+			cacheEntry.Hit = true
+			return cacheEntry, nil
 		}
+		return nil, err
+	}
+	return freshEntry, nil
+}
 
+// fetchMetadata retrieves metadata from the upstream and shares it with the
+// cluster. An expired entry is revalidated rather than fetched again, and
+// dropped if the upstream says it is no longer valid.
+func (mc *memoryCache) fetchMetadata(ctx context.Context, url string, clientHeaders http.Header, expired *hydrator.CacheEntry) (*hydrator.CacheEntry, error) {
+	cacheEntry, err := mc.hydrateMetadata(ctx, url, clientHeaders, expired)
+	if err == nil {
 		if err := mc.metadata.Add(url, *cacheEntry); err != nil {
 			return nil, err
 		}
+		return cacheEntry, nil
+	}
+
+	if statusErr, ok := err.(hydrator.StatusError); ok && mc.negativeStatusCodes[statusErr.StatusCode] && mc.negativeTTL > 0 {
+		negativeEntry := hydrator.CacheEntry{
+			ObjectResults: &cacheobject.ObjectResults{
+				OutExpirationTime: time.Now().Add(mc.negativeTTL),
+			},
+			Metadata:       make(map[string]string),
+			MustRevalidate: true,
+			StatusCode:     statusErr.StatusCode,
+		}
+		if err := mc.metadata.Add(url, negativeEntry); err != nil {
+			logger.Debugln("Unable to cache", url, statusErr, err)
+		}
+	} else if expired != nil && !isUpstreamFailure(err) {
+		mc.metadata.Remove(url)
+	}
+	return nil, err
+}
+
+// hydrateMetadata retrieves metadata from the upstream and checks that the
+// object may be cached.
+func (mc *memoryCache) hydrateMetadata(ctx context.Context, url string, clientHeaders http.Header, expired *hydrator.CacheEntry) (*hydrator.CacheEntry, error) {
+	var cacheEntry *hydrator.CacheEntry
+	var err error
+	if expired != nil {
+		cacheEntry, err = mc.hydrator.Revalidate(ctx, url, expired)
+	} else {
+		cacheEntry, err = mc.hydrator.GetMetadata(ctx, url, clientHeaders)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cacheEntry.VariesOnAll() {
+		return nil, NotCacheable{Reasons: []string{ReasonVaryStar}}
+	}
+
+	if len(cacheEntry.ObjectResults.OutReasons) > 0 {
+		reasons := make([]string, 0, len(cacheEntry.ObjectResults.OutReasons))
+		for _, reason := range cacheEntry.ObjectResults.OutReasons {
+			reasons = append(reasons, reason.String())
+		}
+		return nil, NotCacheable{Reasons: reasons}
+	}
+
+	//now := time.Now()
+	//exp := cacheEntry.ObjectResults.OutExpirationTime
+	//log.Println("Now:", now)
+	//log.Println("Exp:", exp)
+	if cacheEntry.ObjectResults.OutExpirationTime.Before(time.Now().Add(60 * time.Second)) {
+		//log.Println("SKIP")
+		return nil, NotCacheable{Reasons: []string{ReasonExpiresTooSoon}}
+	} else if v, ok := cacheEntry.Metadata["Accept-Ranges"]; ok == true {
+		if strings.ToLower(strings.TrimSpace(v)) == "none" {
+			cacheEntry.NoRanges = true
+		}
+	} else {
+		//log.Println("CACHE")
+	}
+	if mc.noUpstreamRanges {
+		cacheEntry.NoRanges = true
+	}
+	if _, ok := cacheEntry.Metadata["Content-Length"]; !ok {
+		// the length is only learned by fetching the object whole
+		cacheEntry.Spooled = true
+		cacheEntry.NoRanges = true
 	}
 	return cacheEntry, nil
 }
 
-func (mc *memoryCache) Get(url string, cacheEntry *hydrator.CacheEntry) (sizereaderat.SizeReaderAt, error) {
+// isUpstreamFailure reports whether err means the upstream could not answer,
+// as opposed to answering that the object can't be served from cache.
+func isUpstreamFailure(err error) bool {
+	switch e := err.(type) {
+	case NotCacheable:
+		return false
+	case hydrator.StatusError:
+		return e.StatusCode >= 500
+	}
+	return true
+}
 
-	// Just passing headers in naively
-	sum, err := GenerateKey(url, cacheEntry.Metadata)
-	key := hex.EncodeToString(sum[:])
-	metadataRequest := MetadataRequest{
-		Url:     url,
-		Key:     key,
-		Headers: cacheEntry.Metadata,
+// revalidate refreshes the metadata of url in the background. Only one
+// revalidation per url runs at a time.
+func (mc *memoryCache) revalidate(url string, expired *hydrator.CacheEntry) {
+	variantKey := VariantKey(url, expired.Variant)
+	mc.revalidatingLock.Lock()
+	if mc.revalidating[variantKey] {
+		mc.revalidatingLock.Unlock()
+		return
+	}
+	mc.revalidating[variantKey] = true
+	mc.revalidatingLock.Unlock()
+
+	go func() {
+		defer func() {
+			mc.revalidatingLock.Lock()
+			delete(mc.revalidating, variantKey)
+			mc.revalidatingLock.Unlock()
+		}()
+		// the client doesn't wait for it, so it isn't tied to its context
+		if _, err := mc.fetchMetadata(context.Background(), url, nil, expired); err != nil && isUpstreamFailure(err) {
+			logger.Warnln("Unable to revalidate", url, err)
+		}
+	}()
+}
+
+// Invalidate drops the metadata of url on every node. Blocks are keyed by
+// the object's validators, so they don't need to be removed.
+func (mc *memoryCache) Invalidate(url string) error {
+	return mc.metadata.Remove(url)
+}
+
+// noRanges remembers that the upstream of cacheEntry ignored a Range
+// request, so that the object is fetched whole from now on.
+func (mc *memoryCache) noRanges(url string, cacheEntry hydrator.CacheEntry) {
+	if cacheEntry.NoRanges {
+		return
+	}
+	cacheEntry.NoRanges = true
+	cacheEntry.Hit = false
+	cacheEntry.Warning = ""
+	if err := mc.metadata.Add(url, cacheEntry); err != nil {
+		logger.Warnln("Unable to update", url, err)
+	}
+}
+
+func (mc *memoryCache) Purge(url string) error {
+	return mc.metadata.Purge(url, false)
+}
+
+func (mc *memoryCache) PurgePrefix(prefix string) error {
+	return mc.metadata.Purge(prefix, true)
+}
+
+func (mc *memoryCache) PurgeAll() error {
+	return mc.metadata.Purge("", true)
+}
+
+func (mc *memoryCache) PurgeTag(tag string) error {
+	return mc.metadata.PurgeTag(tag)
+}
+
+// Leave moves this node's share of the objects to its peers ahead of a
+// shutdown.
+func (mc *memoryCache) Leave() error {
+	return leave()
+}
+
+// Shutdown stops serving peers and closes the disk cache.
+func (mc *memoryCache) Shutdown() error {
+	if err := stopServingPeers(mc.drainTimeout); err != nil {
+		logger.Warnln("Unable to drain peer requests", err)
 	}
+	if mc.diskCache != nil {
+		return mc.diskCache.Shutdown()
+	}
+	return nil
+}
 
-	ctx := cacheContext{
+// spooled records the length of an object the upstream didn't give one for,
+// once it has been read to the end.
+func (mc *memoryCache) spooled(url string, cacheEntry hydrator.CacheEntry, size int64) {
+	if _, ok := cacheEntry.Metadata["Content-Length"]; ok {
+		return
+	}
+	metadata := make(map[string]string, len(cacheEntry.Metadata)+1)
+	for k, v := range cacheEntry.Metadata {
+		metadata[k] = v
+	}
+	metadata["Content-Length"] = strconv.FormatInt(size, 10)
+	cacheEntry.Metadata = metadata
+	cacheEntry.Hit = false
+	cacheEntry.Warning = ""
+	if err := mc.metadata.Add(url, cacheEntry); err != nil {
+		logger.Warnln("Unable to update", url, err)
+	}
+}
+
+// blockHeaders are the headers of the metadata blocks are loaded with. They
+// identify the version of the object, the rest of the metadata changes on
+// every revalidation and would move the blocks to other keys and peers.
+var blockHeaders = []string{"Content-Length", "Content-Encoding", "Content-Md5", "Etag", "Last-Modified"}
+
+// metadataRequest describes the object blocks are loaded for. Spooled objects
+// are keyed without the length that was learned by spooling them.
+func (mc *memoryCache) metadataRequest(url string, cacheEntry *hydrator.CacheEntry) (MetadataRequest, error) {
+	headers := make(map[string]string, len(blockHeaders))
+	for _, k := range blockHeaders {
+		if v, ok := cacheEntry.Metadata[k]; ok {
+			headers[k] = v
+		}
+	}
+	if cacheEntry.Spooled {
+		delete(headers, "Content-Length")
+	}
+	sum, err := GenerateKey(url, headers, cacheEntry.Variant, mc.metadata.Generation(url))
+	if err != nil {
+		return MetadataRequest{}, err
+	}
+	return MetadataRequest{
+		Url:     url,
+		Key:     hex.EncodeToString(sum[:]),
+		Headers: headers,
+		Variant: cacheEntry.Variant,
+	}, nil
+}
+
+func (mc *memoryCache) blockContext(ctx context.Context, cacheEntry *hydrator.CacheEntry, provenance *hydrator.Provenance) cacheContext {
+	blockCtx := cacheContext{
+		ctx:       ctx,
 		diskCache: mc.diskCache,
 		hydrator:  mc.hydrator,
+		location:  cacheEntry.Location,
 	}
+	if provenance != nil {
+		blockCtx.requestID = provenance.RequestID
+	}
+	return blockCtx
+}
+
+// Stream reads an object of unknown length block after block, until a short
+// one. The blocks are fetched whole and spooled to disk on the way.
+func (mc *memoryCache) Stream(ctx context.Context, url string, cacheEntry *hydrator.CacheEntry, provenance *hydrator.Provenance) (io.Reader, error) {
+	metadataRequest, err := mc.metadataRequest(url, cacheEntry)
+	if err != nil {
+		return nil, err
+	}
+	part := lazyReaderAt{
+		request: dataRequest{
+			MetadataRequest: metadataRequest,
+			Size:            -1,
+			BlockSize:       mc.blockSize,
+			Whole:           true,
+		},
+		size:       mc.blockSize,
+		groupName:  mc.groupName,
+		ctx:        mc.blockContext(ctx, cacheEntry, provenance),
+		provenance: provenance,
+		invalidate: mc.Invalidate,
+	}
+	return &spoolReader{
+		part: part,
+		complete: func(size int64) {
+			mc.spooled(url, *cacheEntry, size)
+		},
+	}, nil
+}
+
+func (mc *memoryCache) Get(ctx context.Context, url string, cacheEntry *hydrator.CacheEntry, provenance *hydrator.Provenance) (sizereaderat.SizeReaderAt, error) {
+	metadataRequest, err := mc.metadataRequest(url, cacheEntry)
+	if err != nil {
+		return nil, err
+	}
+	blockCtx := mc.blockContext(ctx, cacheEntry, provenance)
 
 	totalSize, err := strconv.ParseInt(cacheEntry.Metadata["Content-Length"], 10, 64)
 	if err != nil {
@@ -218,22 +582,31 @@ func (mc *memoryCache) Get(url string, cacheEntry *hydrator.CacheEntry) (sizerea
 
 	var parts []sizereaderat.SizeReaderAt
 	sizeLeft := totalSize
+	// set once a block finds the upstream ignoring Range, for all of them
+	whole := new(int32)
 	for i := 0; i < blockCount; i++ {
 		request := dataRequest{
 			MetadataRequest: metadataRequest,
 			Block:           int64(i),
 			Size:            totalSize,
 			BlockSize:       mc.blockSize,
+			Whole:           cacheEntry.NoRanges,
 		}
 		partSize := mc.blockSize
 		if sizeLeft < partSize {
 			partSize = sizeLeft
 		}
 		part := lazyReaderAt{
-			request:   request,
-			size:      partSize,
-			groupName: mc.groupName,
-			ctx:       ctx,
+			request:    request,
+			size:       partSize,
+			groupName:  mc.groupName,
+			ctx:        blockCtx,
+			provenance: provenance,
+			invalidate: mc.Invalidate,
+			noRanges: func() {
+				mc.noRanges(url, *cacheEntry)
+			},
+			whole: whole,
 		}
 		sizeLeft = sizeLeft - part.size
 		//go part.ReadAt(make([]byte, 1), 0) // Preload cache
@@ -250,22 +623,39 @@ func (mc *memoryCache) getRange(url string, offset int64, length int64) (io.Read
 }
 
 var setupPool = sync.Once{}
+var joinCluster = sync.Once{}
 
 func NewCache(config Config) hydrator.Cache {
+	me := "http://127.0.0.1:8000"
+	if config.PeeringAddress != "" {
+		me = config.PeeringAddress
+	}
 	setupPool.Do(func() {
-		me := "http://127.0.0.1:8000"
 		regex := regexp.MustCompile("https?://")
-		if config.PeeringAddress != "" {
-			me = config.PeeringAddress
-		}
 		addr := regex.ReplaceAllString(me, "")
-		peers := groupcache.NewHTTPPool(me)
+		peers := groupcache.NewHTTPPoolOpts(me, &groupcache.HTTPPoolOptions{HashFn: peerHash})
 		peers.Context = func(req *http.Request) groupcache.Context {
+			tiers, _ := req.Context().Value(tierPathContextKey{}).(*tierPath)
+			loadCtx, _ := req.Context().Value(loadContextKey{}).(context.Context)
 			return cacheContext{
+				ctx:       loadCtx,
 				diskCache: config.DiskCache,
 				hydrator:  config.Hydrator,
+				tiers:     tiers,
+				requestID: req.Header.Get(accesslog.RequestIDHeader),
 			}
 		}
+		peers.Transport = newPeerTransport
+		if len(config.Etcd) == 0 {
+			// standalone, this node is its only peer
+			membership.lock.Lock()
+			membership.self = me
+			membership.pool = peers
+			membership.tracked = []string{me}
+			applyPeers()
+			membership.lock.Unlock()
+			return
+		}
 		etcdConfig := client.Config{
 			Endpoints: config.Etcd,
 			//Transport:               client.DefaultTransport,
@@ -275,15 +665,25 @@ func NewCache(config Config) hydrator.Cache {
 		if err != nil {
 			log.Fatalln("Could not connect to etcd")
 		}
+		server := &http.Server{
+			Addr:    addr,
+			Handler: accesslog.NewHandler(reportTiers(peers), os.Stdout, config.AccessLogFormat, "peer"),
+		}
+		membership.lock.Lock()
+		membership.self = me
+		membership.pool = peers
+		membership.server = server
+		membership.lock.Unlock()
 		time.Sleep(2 * time.Second)
-		peertracker.NewPeerTracker(etcdClient, me, "/tigerbat/peers", 60*time.Second, func(newPeers []string) {
-			log.Println("Settings peers:", newPeers)
-			peers.Set(newPeers...)
+		peertracker.NewPeerTracker(etcdClient, me, peersDir, 60*time.Second, func(newPeers []string) {
+			logger.Infoln("Setting peers:", newPeers)
+			setPeers(newPeers)
 		})
+		membership.lock.Lock()
+		membership.peers = client.NewKeysAPI(etcdClient)
+		membership.lock.Unlock()
 		go func() {
-			handler := peers
-			//handler = handlers.LoggingHandler(os.Stderr, peers)
-			if err := http.ListenAndServe(addr, handler); err != nil {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 				log.Panicln(err)
 			}
 		}()
@@ -294,26 +694,48 @@ func NewCache(config Config) hydrator.Cache {
 	}
 
 	group := groupcache.NewGroup(config.GroupName, config.MaxMemoryUsage, groupcache.GetterFunc(getterFunc))
+	groupStats.add(group)
 
-	etcdConfig := clientv3.Config{
-		Endpoints: config.Etcd,
-	}
+	mdCache := NewMetadataCache()
+	if len(config.Etcd) == 0 {
+		NewLocalSyncer(mdCache)
+	} else {
+		etcdConfig := clientv3.Config{
+			Endpoints: config.Etcd,
+		}
 
-	etcdClientV3, err := clientv3.New(etcdConfig)
-	if err != nil {
-		log.Panicln(err)
+		etcdClientV3, err := clientv3.New(etcdConfig)
+		if err != nil {
+			log.Panicln(err)
+		}
+
+		joinCluster.Do(func() {
+			join(etcdClientV3, me)
+		})
+
+		NewMetadataSyncer(mdCache, etcdClientV3, config.StaleGracePeriod)
 	}
 
-	mdCache := NewMetadataCache()
-	NewMetadataSyncer(mdCache, etcdClientV3)
+	negativeStatusCodes := make(map[int]bool)
+	for _, statusCode := range config.NegativeStatusCodes {
+		negativeStatusCodes[statusCode] = true
+	}
 
 	mc := &memoryCache{
-		group:     group,
-		diskCache: config.DiskCache,
-		hydrator:  config.Hydrator,
-		blockSize: config.BlockSize,
-		groupName: config.GroupName,
-		metadata:  mdCache,
+		group:               group,
+		diskCache:           config.DiskCache,
+		hydrator:            config.Hydrator,
+		blockSize:           config.BlockSize,
+		groupName:           config.GroupName,
+		metadata:            mdCache,
+		staleGrace:          config.StaleGracePeriod,
+		negativeTTL:         config.NegativeTTL,
+		negativeStatusCodes: negativeStatusCodes,
+		revalidating:        make(map[string]bool),
+
+		ignoreClientRevalidation: config.IgnoreClientRevalidation,
+		noUpstreamRanges:         config.NoUpstreamRanges,
+		drainTimeout:             config.DrainTimeout,
 	}
 
 	return mc
@@ -323,6 +745,10 @@ type mcContext struct{}
 
 func getterFunc(ctx groupcache.Context, key string, dest groupcache.Sink) error {
 	typedCtx := ctx.(cacheContext)
+	if typedCtx.ctx == nil {
+		typedCtx.ctx = context.Background()
+	}
+	key = routedKey(key)
 
 	dataRegex, err := regexp.Compile("^data\\/")
 	metadataRegex, err := regexp.Compile("^metadata\\/")
@@ -333,7 +759,14 @@ func getterFunc(ctx groupcache.Context, key string, dest groupcache.Sink) error
 		if err != nil {
 			return err
 		}
-		cacheEntry, err := typedCtx.hydrator.GetMetadata(info.Url)
+		clientHeaders := make(http.Header)
+		for k, v := range info.Variant {
+			clientHeaders.Set(k, v)
+		}
+		if typedCtx.requestID != "" {
+			clientHeaders.Set(accesslog.RequestIDHeader, typedCtx.requestID)
+		}
+		cacheEntry, err := typedCtx.hydrator.GetMetadata(typedCtx.ctx, info.Url, clientHeaders)
 		if err != nil {
 			return err
 		}
@@ -355,24 +788,50 @@ func getterFunc(ctx groupcache.Context, key string, dest groupcache.Sink) error
 			end = info.Size
 		}
 		diskKey := info.Key + "-" + strconv.FormatInt(info.Block, 10)
-		reader, err := typedCtx.diskCache.Get(diskKey)
+		reader, err := typedCtx.diskCache.Get(typedCtx.ctx, diskKey)
 		if err == nil {
 			data, err := ioutil.ReadAll(reader)
 			if err == nil {
+				typedCtx.tiers.add(hydrator.TierDisk)
 				dest.SetBytes(data)
 				return nil
 			}
 		}
 
+		if info.Whole {
+			data, err := loadWhole(typedCtx, info)
+			if err != nil {
+				return err
+			}
+			typedCtx.tiers.add(hydrator.TierUpstream)
+			typedCtx.tiers.addUpstreamBytes(int64(len(data)))
+			dest.SetBytes(data)
+			return nil
+		}
+
 		// if not on disk, hydrate from upstream and store to disk
-		data, err := typedCtx.hydrator.Get(info.Url, start, end)
+		cacheEntry := &hydrator.CacheEntry{
+			Metadata:  info.Headers,
+			Variant:   info.Variant,
+			Location:  typedCtx.location,
+			RequestID: typedCtx.requestID,
+		}
+		// readers on this node stream the block while it arrives
+		fill, stop := startStream(diskKey, end-start)
+		defer stop()
+		err = typedCtx.hydrator.GetInto(typedCtx.ctx, info.Url, cacheEntry, start, end, fill)
+		fill.finish(err)
 		if err != nil {
 			return err
 		}
-		err = typedCtx.diskCache.Put(diskKey, bytes.NewBuffer(data))
+		data := fill.data
+		// the block is here, keep it even if nobody waits for it anymore
+		err = typedCtx.diskCache.Put(context.Background(), diskKey, bytes.NewBuffer(data))
 		if err != nil {
 			return err
 		}
+		typedCtx.tiers.add(hydrator.TierUpstream)
+		typedCtx.tiers.addUpstreamBytes(int64(len(data)))
 		dest.SetBytes(data)
 		return nil
 	} else {
@@ -3,11 +3,17 @@ package gcache
 import (
 	"bytes"
 	"errors"
+	"github.com/fkautz/tigerbat/cache/hydrator"
+	"github.com/pquerna/cachecontrol/cacheobject"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"golang.org/x/net/context"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 type testHydrator struct {
@@ -18,11 +24,16 @@ type testDiskCache struct {
 	mock.Mock
 }
 
+// testEntry is the metadata of the object the tests read.
+func testEntry() *hydrator.CacheEntry {
+	return &hydrator.CacheEntry{Metadata: map[string]string{"Content-Length": "2048"}}
+}
+
 func TestDiskCacheAccess(t *testing.T) {
 	hydrator := new(testHydrator)
 	diskCache := new(testDiskCache)
 
-	diskCache.On("Get", "foo").Return(ioutil.NopCloser(bytes.NewBuffer(make([]byte, 2048, 2048))), nil)
+	diskCache.On("Get", mock.Anything).Return(ioutil.NopCloser(bytes.NewBuffer(make([]byte, 2048, 2048))), nil)
 	//hydrator.On("Get", "foo").Return(make([]byte, 2048, 2048), nil)
 
 	config := Config{
@@ -34,7 +45,7 @@ func TestDiskCacheAccess(t *testing.T) {
 	}
 
 	cache := NewCache(config)
-	reader, err := cache.Get("foo", make(map[string]string))
+	reader, err := cache.Get(context.Background(), "foo", testEntry(), nil)
 	if err != nil {
 		t.Fail()
 	}
@@ -50,9 +61,9 @@ func TestHydratorAccess(t *testing.T) {
 	hydrator := new(testHydrator)
 	diskCache := new(testDiskCache)
 
-	diskCache.On("Get", "foo").Return(nil, errors.New("Not Found"))
-	hydrator.On("Get", "foo", int64(0), int64(1048576)).Return(make([]byte, 10, 10), nil)
-	diskCache.On("Put", "foo", mock.Anything).Return(nil)
+	diskCache.On("Get", mock.Anything).Return(nil, errors.New("Not Found"))
+	hydrator.On("Get", "foo", mock.Anything, int64(0), int64(2048)).Return(make([]byte, 10, 10), nil)
+	diskCache.On("Put", mock.Anything, mock.Anything).Return(nil)
 
 	config := Config{
 		BlockSize:      int64(1 * 1024 * 1024),
@@ -62,7 +73,7 @@ func TestHydratorAccess(t *testing.T) {
 		GroupName:      "testhydrator",
 	}
 	cache := NewCache(config)
-	reader, err := cache.Get("foo", make(map[string]string))
+	reader, err := cache.Get(context.Background(), "foo", testEntry(), nil)
 	if err != nil {
 		t.Fail()
 	}
@@ -74,8 +85,288 @@ func TestHydratorAccess(t *testing.T) {
 	hydrator.AssertExpectations(t)
 }
 
-func (m *testHydrator) Get(url string, offset int64, length int64) ([]byte, error) {
-	args := m.Called(url, offset, length)
+// nopSyncer keeps metadata on this node only.
+type nopSyncer struct {
+	MetadataSyncer
+}
+
+func (nopSyncer) Add(key string, value hydrator.CacheEntry) error {
+	return nil
+}
+
+func (nopSyncer) Remove(key string) error {
+	return nil
+}
+
+// metadataTestCache returns a cache serving metadata from upstream, holding
+// entry for "foo" if it isn't nil.
+func metadataTestCache(upstream hydrator.Hydrator, entry *hydrator.CacheEntry) *memoryCache {
+	metadata := NewMetadataCache()
+	metadata.AddSync(nopSyncer{})
+	if entry != nil {
+		metadata.AddWithoutSync("foo", *entry)
+	}
+	return &memoryCache{metadata: metadata, hydrator: upstream, revalidating: make(map[string]bool)}
+}
+
+// expiredEntry returns an entry that expired ago, cacheable for an hour if
+// revalidated.
+func expiredEntry(ago time.Duration) *hydrator.CacheEntry {
+	return &hydrator.CacheEntry{
+		ObjectResults: &cacheobject.ObjectResults{OutExpirationTime: time.Now().Add(-ago)},
+		Metadata:      map[string]string{"Content-Length": "10"},
+	}
+}
+
+func TestGetMetadataStale(t *testing.T) {
+	upstreamDown := hydrator.UpstreamError{Err: errors.New("connection refused")}
+	tests := []struct {
+		name        string
+		expired     time.Duration
+		revalidate  time.Duration
+		ifError     time.Duration
+		must        bool
+		grace       time.Duration
+		upstreamErr error
+		warning     string
+		err         bool
+	}{
+		{"fresh", -time.Hour, 0, 0, false, 0, nil, "", false},
+		{"while revalidating", 10 * time.Second, time.Minute, 0, false, 0, nil, hydrator.WarningResponseIsStale, false},
+		{"past revalidation window", 2 * time.Minute, time.Minute, 0, false, 0, nil, "", false},
+		{"on error", 2 * time.Minute, time.Minute, 10 * time.Minute, false, 0, upstreamDown, hydrator.WarningRevalidationFailed, false},
+		{"on upstream 503", 2 * time.Minute, 0, 10 * time.Minute, false, 0, hydrator.StatusError{StatusCode: 503}, hydrator.WarningRevalidationFailed, false},
+		{"not on 404", 2 * time.Minute, 0, 10 * time.Minute, false, 0, hydrator.StatusError{StatusCode: 404}, "", true},
+		{"not when uncacheable", 2 * time.Minute, 0, 10 * time.Minute, false, 0, NotCacheable{}, "", true},
+		{"past error window", time.Hour, 0, 10 * time.Minute, false, 0, upstreamDown, "", true},
+		{"must revalidate", 10 * time.Second, time.Minute, time.Minute, true, 0, upstreamDown, "", true},
+		{"operator grace", 10 * time.Second, 0, 0, false, time.Minute, nil, hydrator.WarningResponseIsStale, false},
+		{"operator grace on error", 2 * time.Minute, 0, 0, false, 5 * time.Minute, upstreamDown, hydrator.WarningResponseIsStale, false},
+	}
+	for _, test := range tests {
+		cached := expiredEntry(test.expired)
+		cached.StaleWhileRevalidate = test.revalidate
+		cached.StaleIfError = test.ifError
+		cached.MustRevalidate = test.must
+		var revalidated *hydrator.CacheEntry
+		if test.upstreamErr == nil {
+			revalidated = expiredEntry(-time.Hour)
+		}
+		upstream := new(testHydrator)
+		upstream.On("Revalidate", "foo", mock.Anything).Return(revalidated, test.upstreamErr)
+		mc := metadataTestCache(upstream, cached)
+		mc.staleGrace = test.grace
+
+		cacheEntry, err := mc.GetMetadata(context.Background(), "foo", http.Header{})
+		assert.Equal(t, test.err, err != nil, test.name)
+		if err == nil {
+			assert.Equal(t, test.warning, cacheEntry.Warning, test.name)
+		}
+		// wait for the revalidation in the background to finish
+		assert.Eventually(t, func() bool {
+			mc.revalidatingLock.Lock()
+			defer mc.revalidatingLock.Unlock()
+			return len(mc.revalidating) == 0
+		}, time.Second, time.Millisecond, test.name)
+		if test.expired < 0 {
+			upstream.AssertNotCalled(t, "Revalidate", "foo", mock.Anything)
+		} else {
+			upstream.AssertNumberOfCalls(t, "Revalidate", 1)
+		}
+	}
+}
+
+func TestStaleRevalidatesOnce(t *testing.T) {
+	cached := expiredEntry(time.Second)
+	cached.StaleWhileRevalidate = time.Minute
+	release := make(chan time.Time)
+	upstream := new(testHydrator)
+	upstream.On("Revalidate", "foo", mock.Anything).WaitUntil(release).Return(expiredEntry(-time.Hour), nil)
+	mc := metadataTestCache(upstream, cached)
+
+	for i := 0; i < 3; i++ {
+		cacheEntry, err := mc.GetMetadata(context.Background(), "foo", http.Header{})
+		assert.Nil(t, err)
+		assert.Equal(t, hydrator.WarningResponseIsStale, cacheEntry.Warning)
+	}
+	close(release)
+	assert.Eventually(t, func() bool {
+		mc.revalidatingLock.Lock()
+		defer mc.revalidatingLock.Unlock()
+		return len(mc.revalidating) == 0
+	}, time.Second, time.Millisecond)
+	upstream.AssertNumberOfCalls(t, "Revalidate", 1)
+
+	cacheEntry, err := mc.GetMetadata(context.Background(), "foo", http.Header{})
+	assert.Nil(t, err)
+	assert.Equal(t, "", cacheEntry.Warning)
+	assert.True(t, cacheEntry.Hit)
+}
+
+func TestNegativeCaching(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		ttl    time.Duration
+		cached bool
+	}{
+		{"not found", http.StatusNotFound, time.Minute, true},
+		{"gone", http.StatusGone, time.Minute, true},
+		{"status not configured", http.StatusForbidden, time.Minute, false},
+		{"upstream failure", http.StatusBadGateway, time.Minute, false},
+		{"no negative ttl", http.StatusNotFound, 0, false},
+	}
+	for _, test := range tests {
+		upstream := new(testHydrator)
+		upstream.On("GetMetadata", "foo", mock.Anything).Return((*hydrator.CacheEntry)(nil), hydrator.StatusError{StatusCode: test.status})
+		mc := metadataTestCache(upstream, nil)
+		mc.negativeTTL = test.ttl
+		mc.negativeStatusCodes = map[int]bool{http.StatusNotFound: true, http.StatusGone: true}
+
+		for i := 0; i < 2; i++ {
+			_, err := mc.GetMetadata(context.Background(), "foo", http.Header{})
+			assert.Equal(t, hydrator.StatusError{StatusCode: test.status}, err, test.name)
+		}
+		calls := 2
+		if test.cached {
+			calls = 1
+		}
+		upstream.AssertNumberOfCalls(t, "GetMetadata", calls)
+
+		_, err := mc.GetMetadata(context.Background(), "foo", http.Header{"Cache-Control": {"only-if-cached"}})
+		if test.cached {
+			assert.Equal(t, hydrator.StatusError{StatusCode: test.status}, err, test.name)
+		} else {
+			assert.Equal(t, ErrNotCached, err, test.name)
+		}
+	}
+}
+
+func TestNegativeEntryExpires(t *testing.T) {
+	upstream := new(testHydrator)
+	upstream.On("GetMetadata", "foo", mock.Anything).Return(expiredEntry(-time.Hour), nil)
+	negative := expiredEntry(time.Second)
+	negative.StatusCode = http.StatusNotFound
+	negative.StaleIfError = time.Hour
+	mc := metadataTestCache(upstream, negative)
+
+	// expired negative entries are never served, not even stale
+	cacheEntry, err := mc.GetMetadata(context.Background(), "foo", http.Header{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, cacheEntry.StatusCode)
+	upstream.AssertNumberOfCalls(t, "GetMetadata", 1)
+}
+
+func TestGenerateKeyVariant(t *testing.T) {
+	headers := map[string]string{"Etag": `"v1"`, "Content-Length": "10"}
+	identity, err := GenerateKey("foo", headers, nil, 0)
+	assert.Nil(t, err)
+	gzip, err := GenerateKey("foo", headers, map[string]string{"Accept-Encoding": "gzip"}, 0)
+	assert.Nil(t, err)
+	again, err := GenerateKey("foo", headers, map[string]string{"Accept-Encoding": "gzip"}, 0)
+	assert.Nil(t, err)
+	br, err := GenerateKey("foo", headers, map[string]string{"Accept-Encoding": "br"}, 0)
+	assert.Nil(t, err)
+
+	assert.Equal(t, gzip, again)
+	assert.NotEqual(t, identity, gzip)
+	assert.NotEqual(t, gzip, br)
+}
+
+func TestGetMetadataVaryStar(t *testing.T) {
+	upstream := new(testHydrator)
+	upstream.On("GetMetadata", "foo", mock.Anything).Return(&hydrator.CacheEntry{
+		ObjectResults: &cacheobject.ObjectResults{OutExpirationTime: time.Now().Add(time.Hour)},
+		Metadata:      map[string]string{"Content-Length": "10"},
+		Vary:          []string{"*"},
+	}, nil)
+	mc := metadataTestCache(upstream, nil)
+
+	_, err := mc.GetMetadata(context.Background(), "foo", http.Header{})
+	assert.Equal(t, NotCacheable{Reasons: []string{ReasonVaryStar}}, err)
+	_, ok := mc.metadata.Get("foo", http.Header{})
+	assert.False(t, ok)
+}
+
+func TestBlockKeySurvivesRevalidation(t *testing.T) {
+	retrieved := time.Now().UTC()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Etag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.Header().Set("Date", retrieved.Add(time.Hour).Format(http.TimeFormat))
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Date", retrieved.Format(http.TimeFormat))
+		w.Header().Set("Content-Length", "10")
+	}))
+	defer upstream.Close()
+	h := hydrator.NewHydrator(upstream.URL, http.DefaultTransport)
+	mc := &memoryCache{metadata: NewMetadataCache(), blockSize: 4}
+
+	blockKey := func(cacheEntry *hydrator.CacheEntry) string {
+		metadataRequest, err := mc.metadataRequest("foo", cacheEntry)
+		assert.Nil(t, err)
+		key, err := dataRequest{MetadataRequest: metadataRequest, Block: 1, Size: 10, BlockSize: 4}.groupKey()
+		assert.Nil(t, err)
+		return key
+	}
+
+	fetched, err := h.GetMetadata(context.Background(), "foo", nil)
+	assert.Nil(t, err)
+	revalidated, err := h.Revalidate(context.Background(), "foo", fetched)
+	assert.Nil(t, err)
+	assert.NotEqual(t, fetched.Metadata["X-Cache-Date-Retrieved"], revalidated.Metadata["X-Cache-Date-Retrieved"])
+	assert.Equal(t, blockKey(fetched), blockKey(revalidated))
+
+	changed := *revalidated
+	changed.Metadata = map[string]string{"Etag": `"v2"`, "Content-Length": "10"}
+	assert.NotEqual(t, blockKey(fetched), blockKey(&changed))
+}
+
+func TestBlockKeyFollowsValidators(t *testing.T) {
+	mc := &memoryCache{metadata: NewMetadataCache(), blockSize: 4}
+	blockKey := func(metadata map[string]string) string {
+		metadataRequest, err := mc.metadataRequest("foo", &hydrator.CacheEntry{Metadata: metadata})
+		assert.Nil(t, err)
+		return metadataRequest.Key
+	}
+
+	lastModified := blockKey(map[string]string{"Content-Length": "10", "Last-Modified": "Mon, 02 Jan 2006 15:04:05 GMT"})
+	assert.NotEqual(t, lastModified, blockKey(map[string]string{"Content-Length": "10", "Last-Modified": "Tue, 03 Jan 2006 15:04:05 GMT"}))
+
+	md5 := blockKey(map[string]string{"Content-Length": "10", "Content-Md5": "Q2hlY2sgSW50ZWdyaXR5IQ=="})
+	assert.NotEqual(t, md5, blockKey(map[string]string{"Content-Length": "10", "Content-Md5": "c29tZXRoaW5nIGVsc2UhIQ=="}))
+}
+
+func TestBlockKeyLeavesOutLocation(t *testing.T) {
+	mc := &memoryCache{metadata: NewMetadataCache(), blockSize: 4}
+	metadata := map[string]string{"Content-Length": "10"}
+	signed := &hydrator.CacheEntry{
+		Metadata: metadata,
+		Location: &hydrator.Location{Url: "http://storage/foo?signature=1", Expires: time.Now().Add(time.Minute)},
+	}
+	resigned := &hydrator.CacheEntry{
+		Metadata: metadata,
+		Location: &hydrator.Location{Url: "http://storage/foo?signature=2", Expires: time.Now().Add(time.Hour)},
+	}
+
+	first, err := mc.metadataRequest("foo", signed)
+	assert.Nil(t, err)
+	second, err := mc.metadataRequest("foo", resigned)
+	assert.Nil(t, err)
+	firstKey, _ := dataRequest{MetadataRequest: first, Size: 10, BlockSize: 4}.groupKey()
+	secondKey, _ := dataRequest{MetadataRequest: second, Size: 10, BlockSize: 4}.groupKey()
+	assert.Equal(t, firstKey, secondKey)
+	assert.NotContains(t, firstKey, "signature")
+
+	// the location still reaches loads on this node
+	assert.Equal(t, signed.Location, mc.blockContext(context.Background(), signed, nil).location)
+}
+
+func (m *testHydrator) Get(ctx context.Context, url string, cacheEntry *hydrator.CacheEntry, offset int64, length int64) ([]byte, error) {
+	args := m.Called(url, cacheEntry, offset, length)
 	var ret0 []byte = nil
 	if args.Get(0) != nil {
 		ret0 = args.Get(0).([]byte)
@@ -87,12 +378,33 @@ func (m *testHydrator) Get(url string, offset int64, length int64) ([]byte, erro
 	return ret0, ret1
 }
 
-func (m *testHydrator) GetMetadata(url string) (map[string]string, error) {
-	args := m.Called(url)
-	return args.Get(0).(map[string]string), args.Get(1).(error)
+func (m *testHydrator) GetInto(ctx context.Context, url string, cacheEntry *hydrator.CacheEntry, offset int64, length int64, dst io.WriterAt) error {
+	data, err := m.Get(ctx, url, cacheEntry, offset, length)
+	if err == nil {
+		_, err = dst.WriteAt(data, 0)
+	}
+	return err
+}
+
+func (m *testHydrator) GetWhole(ctx context.Context, url string, cacheEntry *hydrator.CacheEntry, blockSize int64, block func(index int64, data []byte) error) error {
+	return m.Called(url, cacheEntry, blockSize).Error(0)
 }
 
-func (m *testDiskCache) Get(url string) (io.ReadCloser, error) {
+func (m *testHydrator) GetMetadata(ctx context.Context, url string, clientHeaders http.Header) (*hydrator.CacheEntry, error) {
+	args := m.Called(url, clientHeaders)
+	return args.Get(0).(*hydrator.CacheEntry), args.Error(1)
+}
+
+func (m *testHydrator) Ping() error {
+	return m.Called().Error(0)
+}
+
+func (m *testHydrator) Revalidate(ctx context.Context, url string, cacheEntry *hydrator.CacheEntry) (*hydrator.CacheEntry, error) {
+	args := m.Called(url, cacheEntry)
+	return args.Get(0).(*hydrator.CacheEntry), args.Error(1)
+}
+
+func (m *testDiskCache) Get(ctx context.Context, url string) (io.ReadCloser, error) {
 	args := m.Called(url)
 	var ret0 io.ReadCloser
 	if args.Get(0) != nil {
@@ -105,7 +417,7 @@ func (m *testDiskCache) Get(url string) (io.ReadCloser, error) {
 	return ret0, ret1
 }
 
-func (m *testDiskCache) GetRange(url string, one, two int64) (io.ReadCloser, error) {
+func (m *testDiskCache) GetRange(ctx context.Context, url string, one, two int64) (io.ReadCloser, error) {
 	args := m.Called(url, one, two)
 	return args.Get(0).(io.ReadCloser), args.Get(1).(error)
 }
@@ -113,7 +425,7 @@ func (m *testDiskCache) Hit(url string) error {
 	args := m.Called(url)
 	return args.Get(0).(error)
 }
-func (m *testDiskCache) Put(url string, data io.Reader) error {
+func (m *testDiskCache) Put(ctx context.Context, url string, data io.Reader) error {
 	args := m.Called(url, data)
 	if args.Get(0) == nil {
 		return nil
@@ -121,6 +433,10 @@ func (m *testDiskCache) Put(url string, data io.Reader) error {
 	return args.Get(0).(error)
 }
 
+func (m *testDiskCache) Check() error {
+	return m.Called().Error(0)
+}
+
 func (m *testDiskCache) Shutdown() error {
 	args := m.Called()
 	return args.Get(0).(error)
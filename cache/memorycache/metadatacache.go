@@ -6,28 +6,41 @@ import (
 	"github.com/coreos/etcd/clientv3"
 	"github.com/coreos/etcd/mvcc/mvccpb"
 	"github.com/fkautz/tigerbat/cache/hydrator"
+	"github.com/fkautz/tigerbat/cache/logger"
 	"golang.org/x/net/context"
-	"log"
 	"net/http"
+	neturl "net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type MetadataSyncer interface {
 	Add(key string, value hydrator.CacheEntry) error
 	Remove(key string) error
+	Purge(url string, prefix bool) (int64, error)
+	Tagged(tag string) ([]string, error)
+	Untag(tag string) error
 	Sync()
+	// Watching reports whether changes from other nodes are received.
+	Watching() bool
 }
 
 type metadataSync struct {
-	cache  MetadataCache
-	client *clientv3.Client
+	cache    MetadataCache
+	client   *clientv3.Client
+	grace    time.Duration
+	watching int32
 }
 
-func NewMetadataSyncer(cache MetadataCache, c *clientv3.Client) error {
+// NewMetadataSyncer shares metadata through etcd. Entries are kept until
+// they may no longer be served stale, grace being the operator's minimum.
+func NewMetadataSyncer(cache MetadataCache, c *clientv3.Client, grace time.Duration) error {
 	syncer := &metadataSync{
 		cache:  cache,
 		client: c,
+		grace:  grace,
 	}
 
 	cache.AddSync(syncer)
@@ -37,85 +50,305 @@ func NewMetadataSyncer(cache MetadataCache, c *clientv3.Client) error {
 
 func (syncer *metadataSync) Add(key string, value hydrator.CacheEntry) error {
 	kv := clientv3.NewKV(syncer.client)
+	value.SyncedAt = time.Now()
 	var buf bytes.Buffer
 	encoder := gob.NewEncoder(&buf)
 	encoder.Encode(value)
 	//log.Println(value)
 	//log.Println(buf.String())
-	duration := value.ObjectResults.OutExpirationTime.Sub(time.Now())
+	duration := value.StaleUntil(syncer.grace).Sub(time.Now())
 	ttlInSeconds := int64(duration / time.Second)
 	//log.Println(key+" TTL:", ttlInSeconds)
 	leaseResp, err := syncer.client.Lease.Grant(context.Background(), ttlInSeconds)
 	if err != nil {
 		return err
 	}
-	_, err = kv.Put(context.TODO(), key, string(buf.Bytes()), clientv3.WithLease(leaseResp.ID))
+	_, err = kv.Put(context.TODO(), entryPrefix+key, string(buf.Bytes()), clientv3.WithLease(leaseResp.ID))
 	if err != nil {
 		return err
 	}
+	// the tag index lives as long as the metadata it points to
+	for _, tag := range value.Tags {
+		_, err = kv.Put(context.TODO(), tagRecord(tag)+key, "", clientv3.WithLease(leaseResp.ID))
+		if err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// Tagged returns the urls whose metadata carries tag.
+func (syncer *metadataSync) Tagged(tag string) ([]string, error) {
+	kv := clientv3.NewKV(syncer.client)
+	response, err := kv.Get(context.Background(), tagRecord(tag), clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var urls []string
+	for _, record := range response.Kvs {
+		key := strings.TrimPrefix(string(record.Key), tagRecord(tag))
+		// variants are purged along with their url
+		url := strings.SplitN(key, variantSeparator, 2)[0]
+		if !seen[url] {
+			seen[url] = true
+			urls = append(urls, url)
+		}
+	}
+	return urls, nil
+}
+
+// Untag drops the index of tag.
+func (syncer *metadataSync) Untag(tag string) error {
+	kv := clientv3.NewKV(syncer.client)
+	_, err := kv.Delete(context.Background(), tagRecord(tag), clientv3.WithPrefix())
 	return err
 }
 
 func (syncer *metadataSync) Remove(key string) error {
 	kv := clientv3.NewKV(syncer.client)
-	_, err := kv.Delete(context.Background(), key)
+	_, err := kv.Delete(context.Background(), entryPrefix+key)
+	if err != nil {
+		return err
+	}
+	_, err = kv.Delete(context.Background(), entryPrefix+key+variantSeparator, clientv3.WithPrefix())
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// Purge drops the metadata of url, or of every url starting with it if
+// prefix is set, and records the purge. The revision of the record is the
+// generation purged urls are keyed with from then on.
+func (syncer *metadataSync) Purge(url string, prefix bool) (int64, error) {
+	kv := clientv3.NewKV(syncer.client)
+	record := purgeURLRecord + url
+	if prefix {
+		record = purgePrefixRecord + url
+		_, err := kv.Delete(context.Background(), entryPrefix+url, clientv3.WithPrefix())
+		if err != nil {
+			return 0, err
+		}
+		// earlier purges below the prefix are superseded by this one
+		_, err = kv.Delete(context.Background(), purgeURLRecord+url, clientv3.WithPrefix())
+		if err != nil {
+			return 0, err
+		}
+		_, err = kv.Delete(context.Background(), record, clientv3.WithPrefix())
+		if err != nil {
+			return 0, err
+		}
+	} else if err := syncer.Remove(url); err != nil {
+		return 0, err
+	}
+	response, err := kv.Put(context.Background(), record, "")
+	if err != nil {
+		return 0, err
+	}
+	return response.Header.Revision, nil
+}
+
 func (syncer *metadataSync) Sync() {
 	// set up etcd
+	options := []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithCreatedNotify()}
+
+	// purges made before we started still decide which blocks are current
+	kv := clientv3.NewKV(syncer.client)
+	purges, err := kv.Get(context.Background(), purgePrefix, clientv3.WithPrefix())
+	if err != nil {
+		logger.Errorln("Unable to load purges", err)
+	} else {
+		for _, purge := range purges.Kvs {
+			syncer.cache.PurgeWithoutSync(string(purge.Key), purge.ModRevision)
+		}
+		options = append(options, clientv3.WithRev(purges.Header.Revision+1))
+	}
+
 	watcher := clientv3.NewWatcher(syncer.client)
-	ch := watcher.Watch(context.Background(), "", clientv3.WithPrefix())
+	ch := watcher.Watch(context.Background(), metadataPrefix, options...)
+	defer atomic.StoreInt32(&syncer.watching, 0)
 	for response := range ch {
+		if response.Created {
+			atomic.StoreInt32(&syncer.watching, 1)
+		}
 		for _, event := range response.Events {
+			if strings.HasPrefix(string(event.Kv.Key), purgePrefix) {
+				// superseded purges are deleted from etcd, the purge
+				// superseding them drops them here
+				if event.Type == mvccpb.PUT {
+					syncer.cache.PurgeWithoutSync(string(event.Kv.Key), event.Kv.ModRevision)
+				}
+				continue
+			}
+			if !strings.HasPrefix(string(event.Kv.Key), entryPrefix) {
+				continue
+			}
+			key := strings.TrimPrefix(string(event.Kv.Key), entryPrefix)
 			switch event.Type {
 			case mvccpb.PUT:
 				decoder := gob.NewDecoder(bytes.NewBuffer(event.Kv.Value))
 				value := hydrator.CacheEntry{}
 				decoder.Decode(&value)
-				//log.Println("Sync PUT", string(event.Kv.Key), value)
-				syncer.cache.AddWithoutSync(string(event.Kv.Key), value)
+				// includes the clock skew between the nodes
+				if lag := time.Since(value.SyncedAt); !value.SyncedAt.IsZero() && lag >= 0 {
+					metadataSyncLag.Observe(lag.Seconds())
+				}
+				//log.Println("Sync PUT", key, value)
+				syncer.cache.AddWithoutSync(key, value)
 			case mvccpb.DELETE:
-				log.Println("Sync DELETE", string(event.Kv.Key))
-				syncer.cache.RemoveWithoutSync(string(event.Kv.Key))
+				logger.Debugln("Sync DELETE", key)
+				syncer.cache.RemoveWithoutSync(key)
 			default:
-				log.Println("Sync Unknown Type")
+				logger.Debugln("Sync Unknown Type")
+			}
+		}
+	}
+	logger.Warnln("Metadata watch closed")
+}
+
+// Everything the metadata sync keeps in etcd lives below metadataPrefix, the
+// metadata itself below entryPrefix. Purge records and the tag index are
+// kept next to it, so purging every url leaves them alone.
+const (
+	metadataPrefix    = "/tigerbat/meta/"
+	entryPrefix       = metadataPrefix + "entries/"
+	purgePrefix       = metadataPrefix + "purges/"
+	purgeURLRecord    = purgePrefix + "url/"
+	purgePrefixRecord = purgePrefix + "prefix/"
+)
+
+// The tag index maps a tag to the keys of the metadata carrying it.
+const tagPrefix = metadataPrefix + "tags/"
+
+func tagRecord(tag string) string {
+	return tagPrefix + neturl.PathEscape(tag) + "/"
+}
+
+func (syncer *metadataSync) Watching() bool {
+	return atomic.LoadInt32(&syncer.watching) == 1
+}
+
+// localSync keeps metadata on this node only, for nodes running without
+// etcd. Purges are numbered locally.
+type localSync struct {
+	cache    *metadataCache
+	revision int64
+}
+
+// NewLocalSyncer keeps the metadata of a node running standalone.
+func NewLocalSyncer(cache MetadataCache) {
+	cache.AddSync(&localSync{cache: cache.(*metadataCache)})
+}
+
+func (syncer *localSync) Add(key string, value hydrator.CacheEntry) error {
+	return nil
+}
+
+func (syncer *localSync) Remove(key string) error {
+	return nil
+}
+
+func (syncer *localSync) Purge(url string, prefix bool) (int64, error) {
+	return atomic.AddInt64(&syncer.revision, 1), nil
+}
+
+// Tagged returns the keys of the metadata carrying tag.
+func (syncer *localSync) Tagged(tag string) ([]string, error) {
+	syncer.cache.lock.RLock()
+	defer syncer.cache.lock.RUnlock()
+	var keys []string
+	for key, cacheEntry := range syncer.cache.metadata {
+		for _, t := range cacheEntry.Tags {
+			if t == tag {
+				keys = append(keys, key)
+				break
 			}
 		}
 	}
+	return keys, nil
+}
+
+func (syncer *localSync) Untag(tag string) error {
+	return nil
+}
+
+func (syncer *localSync) Sync() {
+}
+
+// Watching is always true, there are no other nodes to hear from.
+func (syncer *localSync) Watching() bool {
+	return true
+}
+
+// variantSeparator separates a url from the request headers selecting one
+// of its variants in a metadata key. '#' never appears in a request path.
+const variantSeparator = "#vary?"
+
+// VariantKey returns the metadata key of the variant of url that the
+// request headers in variant select.
+func VariantKey(url string, variant map[string]string) string {
+	if len(variant) == 0 {
+		return url
+	}
+	values := neturl.Values{}
+	for k, v := range variant {
+		values.Set(k, v)
+	}
+	return url + variantSeparator + values.Encode()
 }
 
 type MetadataCache interface {
 	Add(key string, cacheEntry hydrator.CacheEntry) error
 	AddWithoutSync(key string, metadata hydrator.CacheEntry)
 	Get(key string, clientHeaders http.Header) (*hydrator.CacheEntry, bool)
-	Remove(key string)
+	Remove(key string) error
 	RemoveWithoutSync(key string)
+	Purge(url string, prefix bool) error
+	PurgeTag(tag string) error
+	PurgeWithoutSync(record string, revision int64)
+	Generation(url string) int64
+	Syncing() bool
 	AddSync(syncer MetadataSyncer)
 }
 
 type metadataCache struct {
-	metadata map[string]hydrator.CacheEntry
-	lock     sync.RWMutex
-	syncer   MetadataSyncer
+	metadata       map[string]hydrator.CacheEntry
+	purgedURLs     map[string]int64
+	purgedPrefixes map[string]int64
+	lock           sync.RWMutex
+	syncer         MetadataSyncer
 }
 
 func NewMetadataCache() MetadataCache {
 	return &metadataCache{
 		// Object metadata cache [key: [header: value]]
 		metadata: make(map[string]hydrator.CacheEntry),
+		// Purges still deciding a generation [url or prefix: revision]
+		purgedURLs:     make(map[string]int64),
+		purgedPrefixes: make(map[string]int64),
 	}
 }
 
+// Add stores metadata under key. Entries of a response that varies are
+// stored under their variant key, and under key to record what the url
+// varies on.
 func (cache *metadataCache) Add(key string, metadata hydrator.CacheEntry) error {
 	err := cache.syncer.Add(key, metadata)
 	if err != nil {
 		return err
 	}
 	cache.add(key, metadata)
+	if len(metadata.Vary) == 0 {
+		return nil
+	}
+
+	variantKey := VariantKey(key, metadata.Variant)
+	err = cache.syncer.Add(variantKey, metadata)
+	if err != nil {
+		return err
+	}
+	cache.add(variantKey, metadata)
 	return nil
 }
 
@@ -123,32 +356,151 @@ func (cache *metadataCache) AddWithoutSync(key string, cacheEntry hydrator.Cache
 	cache.add(key, cacheEntry)
 }
 
+// Get returns the metadata of key, picking the variant clientHeaders select
+// if the response varies.
 func (cache *metadataCache) Get(key string, clientHeaders http.Header) (*hydrator.CacheEntry, bool) {
 	cache.lock.RLock()
 	res, ok := cache.metadata[key]
+	if ok && len(res.Vary) > 0 {
+		res, ok = cache.metadata[VariantKey(key, hydrator.Variant(res.Vary, clientHeaders))]
+	}
 	cache.lock.RUnlock()
 	return &res, ok
 }
 
-func (cache *metadataCache) Remove(key string) {
+// Remove drops key and all of its variants on every node.
+func (cache *metadataCache) Remove(key string) error {
+	err := cache.syncer.Remove(key)
+	if err != nil {
+		return err
+	}
 	cache.lock.Lock()
 	delete(cache.metadata, key)
+	for k := range cache.metadata {
+		if strings.HasPrefix(k, key+variantSeparator) {
+			delete(cache.metadata, k)
+		}
+	}
+	metadataEntries.Set(float64(len(cache.metadata)))
 	cache.lock.Unlock()
+	return nil
 }
 
-func (cache *metadataCache) RemoveWithoutSync(key string) {
+// Purge drops the metadata of url, or of every url starting with it if
+// prefix is set, on every node and moves it to a new generation.
+func (cache *metadataCache) Purge(url string, prefix bool) error {
+	revision, err := cache.syncer.Purge(url, prefix)
+	if err != nil {
+		return err
+	}
+	record := purgeURLRecord + url
+	if prefix {
+		record = purgePrefixRecord + url
+	}
+	cache.PurgeWithoutSync(record, revision)
+	return nil
+}
+
+// PurgeTag purges every url whose metadata carries tag.
+func (cache *metadataCache) PurgeTag(tag string) error {
+	urls, err := cache.syncer.Tagged(tag)
+	if err != nil {
+		return err
+	}
+	for _, url := range urls {
+		if err := cache.Purge(url, false); err != nil {
+			return err
+		}
+	}
+	return cache.syncer.Untag(tag)
+}
+
+func (cache *metadataCache) PurgeWithoutSync(record string, revision int64) {
 	cache.lock.Lock()
-	cache.syncer.Remove(key)
-	delete(cache.metadata, key)
-	cache.lock.Unlock()
+	defer cache.lock.Unlock()
+	if strings.HasPrefix(record, purgePrefixRecord) {
+		prefix := strings.TrimPrefix(record, purgePrefixRecord)
+		for k := range cache.metadata {
+			if strings.HasPrefix(k, prefix) {
+				delete(cache.metadata, k)
+			}
+		}
+		if revision > cache.prefixGeneration(prefix) {
+			// earlier purges below the prefix no longer decide a generation
+			for url, purged := range cache.purgedURLs {
+				if strings.HasPrefix(url, prefix) && purged <= revision {
+					delete(cache.purgedURLs, url)
+				}
+			}
+			for below, purged := range cache.purgedPrefixes {
+				if strings.HasPrefix(below, prefix) && purged <= revision {
+					delete(cache.purgedPrefixes, below)
+				}
+			}
+			cache.purgedPrefixes[prefix] = revision
+		}
+	} else {
+		url := strings.TrimPrefix(record, purgeURLRecord)
+		delete(cache.metadata, url)
+		for k := range cache.metadata {
+			if strings.HasPrefix(k, url+variantSeparator) {
+				delete(cache.metadata, k)
+			}
+		}
+		if revision > cache.purgedURLs[url] && revision > cache.prefixGeneration(url) {
+			cache.purgedURLs[url] = revision
+		}
+	}
+	metadataEntries.Set(float64(len(cache.metadata)))
+}
+
+// Generation returns the revision of the latest purge covering url, zero if
+// it was never purged.
+func (cache *metadataCache) Generation(url string) int64 {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	generation := cache.prefixGeneration(url)
+	if revision := cache.purgedURLs[url]; revision > generation {
+		generation = revision
+	}
+	return generation
+}
+
+// prefixGeneration returns the revision of the latest prefix purge covering
+// url, cache.lock must be held.
+func (cache *metadataCache) prefixGeneration(url string) int64 {
+	var generation int64
+	for i := 0; i <= len(url); i++ {
+		if revision, ok := cache.purgedPrefixes[url[:i]]; ok && revision > generation {
+			generation = revision
+		}
+	}
+	return generation
+}
+
+func (cache *metadataCache) RemoveWithoutSync(key string) {
+	cache.remove(key)
 }
 
 func (cache *metadataCache) add(key string, cacheEntry hydrator.CacheEntry) {
 	cache.lock.Lock()
 	cache.metadata[key] = cacheEntry
+	metadataEntries.Set(float64(len(cache.metadata)))
 	cache.lock.Unlock()
 }
 
+func (cache *metadataCache) remove(key string) {
+	cache.lock.Lock()
+	delete(cache.metadata, key)
+	metadataEntries.Set(float64(len(cache.metadata)))
+	cache.lock.Unlock()
+}
+
+// Syncing reports whether metadata is shared with the cluster.
+func (cache *metadataCache) Syncing() bool {
+	return cache.syncer != nil && cache.syncer.Watching()
+}
+
 func (cache *metadataCache) AddSync(syncer MetadataSyncer) {
 	cache.syncer = syncer
 }
@@ -0,0 +1,119 @@
+package gcache
+
+import (
+	"github.com/fkautz/tigerbat/cache/hydrator"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestPurgeGeneration(t *testing.T) {
+	cache := NewMetadataCache().(*metadataCache)
+	cache.AddWithoutSync("http://a/x", hydrator.CacheEntry{})
+	cache.AddWithoutSync("http://b/y", hydrator.CacheEntry{})
+
+	cache.PurgeWithoutSync(purgeURLRecord+"http://a/x", 5)
+	cache.PurgeWithoutSync(purgeURLRecord+"http://b/y", 6)
+	assert.Equal(t, int64(5), cache.Generation("http://a/x"))
+	assert.Equal(t, int64(0), cache.Generation("http://a/z"))
+	_, ok := cache.Get("http://a/x", nil)
+	assert.False(t, ok)
+
+	// the prefix purge supersedes the purge below it
+	cache.PurgeWithoutSync(purgePrefixRecord+"http://a/", 7)
+	assert.Equal(t, int64(7), cache.Generation("http://a/x"))
+	assert.Equal(t, int64(7), cache.Generation("http://a/z"))
+	assert.Equal(t, int64(6), cache.Generation("http://b/y"))
+	assert.Len(t, cache.purgedURLs, 1)
+
+	cache.PurgeWithoutSync(purgeURLRecord+"http://a/x", 9)
+	assert.Equal(t, int64(9), cache.Generation("http://a/x"))
+	assert.Equal(t, int64(7), cache.Generation("http://a/z"))
+
+	// purging everything leaves a single record
+	cache.PurgeWithoutSync(purgePrefixRecord, 10)
+	assert.Len(t, cache.purgedURLs, 0)
+	assert.Equal(t, map[string]int64{"": 10}, cache.purgedPrefixes)
+	assert.Equal(t, int64(10), cache.Generation("http://b/y"))
+	_, ok = cache.Get("http://b/y", nil)
+	assert.False(t, ok)
+
+	// replayed purges never lower a generation
+	cache.PurgeWithoutSync(purgePrefixRecord+"http://a/", 8)
+	cache.PurgeWithoutSync(purgeURLRecord+"http://a/x", 9)
+	assert.Equal(t, int64(10), cache.Generation("http://a/x"))
+	assert.Len(t, cache.purgedURLs, 0)
+	assert.Len(t, cache.purgedPrefixes, 1)
+}
+
+func TestTagRecord(t *testing.T) {
+	record := tagRecord("a/b")
+	assert.Equal(t, metadataPrefix+"tags/a%2Fb/", record)
+	// the watch decodes everything below entryPrefix as metadata
+	assert.NotContains(t, record, entryPrefix)
+}
+
+// removingSyncer records the keys removed from the cluster.
+type removingSyncer struct {
+	MetadataSyncer
+	removed []string
+}
+
+func (s *removingSyncer) Remove(key string) error {
+	s.removed = append(s.removed, key)
+	return nil
+}
+
+func TestInvalidate(t *testing.T) {
+	syncer := &removingSyncer{}
+	cache := NewMetadataCache().(*metadataCache)
+	cache.AddSync(syncer)
+	cache.AddWithoutSync("http://a/x", hydrator.CacheEntry{})
+	cache.AddWithoutSync("http://a/x"+variantSeparator+"gzip", hydrator.CacheEntry{})
+	cache.AddWithoutSync("http://a/xy", hydrator.CacheEntry{})
+	mc := &memoryCache{metadata: cache}
+
+	assert.Nil(t, mc.Invalidate("http://a/x"))
+	assert.Equal(t, []string{"http://a/x"}, syncer.removed)
+	_, ok := cache.metadata["http://a/x"]
+	assert.False(t, ok)
+	_, ok = cache.metadata["http://a/x"+variantSeparator+"gzip"]
+	assert.False(t, ok)
+	_, ok = cache.metadata["http://a/xy"]
+	assert.True(t, ok)
+}
+
+func TestVariantKey(t *testing.T) {
+	assert.Equal(t, "http://a/x", VariantKey("http://a/x", nil))
+	assert.Equal(t, "http://a/x#vary?Accept-Encoding=gzip&Origin=http%3A%2F%2Fb",
+		VariantKey("http://a/x", map[string]string{"Origin": "http://b", "Accept-Encoding": "gzip"}))
+	assert.NotEqual(t, VariantKey("http://a/x", map[string]string{"Accept-Encoding": "gzip"}),
+		VariantKey("http://a/x", map[string]string{"Accept-Encoding": ""}))
+}
+
+func TestGetVariant(t *testing.T) {
+	cache := NewMetadataCache().(*metadataCache)
+	cache.AddSync(nopSyncer{})
+	vary := []string{"Accept-Encoding"}
+	gzip := hydrator.CacheEntry{Vary: vary, Variant: map[string]string{"Accept-Encoding": "gzip"}, Metadata: map[string]string{"Content-Encoding": "gzip"}}
+	identity := hydrator.CacheEntry{Vary: vary, Variant: map[string]string{"Accept-Encoding": ""}, Metadata: map[string]string{}}
+	assert.Nil(t, cache.Add("http://a/x", gzip))
+	assert.Nil(t, cache.Add("http://a/x", identity))
+
+	tests := []struct {
+		clientHeaders http.Header
+		found         bool
+		encoding      string
+	}{
+		{http.Header{"Accept-Encoding": {"gzip"}}, true, "gzip"},
+		{http.Header{}, true, ""},
+		{http.Header{"Accept-Encoding": {"br"}}, false, ""},
+	}
+	for _, test := range tests {
+		cacheEntry, ok := cache.Get("http://a/x", test.clientHeaders)
+		assert.Equal(t, test.found, ok, "%v", test.clientHeaders)
+		if ok {
+			assert.Equal(t, test.encoding, cacheEntry.Metadata["Content-Encoding"], "%v", test.clientHeaders)
+		}
+	}
+}
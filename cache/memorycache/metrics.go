@@ -0,0 +1,115 @@
+package gcache
+
+import (
+	"github.com/golang/groupcache"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+)
+
+var (
+	metadataLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tigerbat",
+		Subsystem: "metadata",
+		Name:      "lookups_total",
+		Help:      "Metadata lookups by result: hit, stale or miss.",
+	}, []string{"result"})
+	metadataEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "tigerbat",
+		Subsystem: "metadata",
+		Name:      "entries",
+		Help:      "Metadata entries held locally, variants included.",
+	})
+	metadataSyncLag = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "tigerbat",
+		Subsystem: "metadata",
+		Name:      "sync_lag_seconds",
+		Help:      "Time from a node sharing metadata through etcd to this node receiving it.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	})
+	peerFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tigerbat",
+		Subsystem: "peer",
+		Name:      "fetches_total",
+		Help:      "Blocks requested from peers by result: ok or error.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(metadataLookups, metadataEntries, metadataSyncLag, peerFetches, groupStats)
+}
+
+// groupCollector exports the stats groupcache keeps for every group.
+type groupCollector struct {
+	lock   sync.Mutex
+	groups []*groupcache.Group
+}
+
+var groupStats = &groupCollector{}
+
+var (
+	groupGetsDesc = prometheus.NewDesc("tigerbat_groupcache_gets_total",
+		"Block gets, including the ones from peers.", []string{"group"}, nil)
+	groupHitsDesc = prometheus.NewDesc("tigerbat_groupcache_hits_total",
+		"Block gets answered from memory.", []string{"group"}, nil)
+	groupPeerLoadsDesc = prometheus.NewDesc("tigerbat_groupcache_peer_loads_total",
+		"Blocks loaded from a peer.", []string{"group"}, nil)
+	groupPeerErrorsDesc = prometheus.NewDesc("tigerbat_groupcache_peer_errors_total",
+		"Failed block loads from a peer.", []string{"group"}, nil)
+	groupLocalLoadsDesc = prometheus.NewDesc("tigerbat_groupcache_local_loads_total",
+		"Blocks loaded from disk or the upstream by this node.", []string{"group"}, nil)
+	groupLocalLoadErrorsDesc = prometheus.NewDesc("tigerbat_groupcache_local_load_errors_total",
+		"Failed block loads from disk or the upstream.", []string{"group"}, nil)
+	groupServerRequestsDesc = prometheus.NewDesc("tigerbat_groupcache_server_requests_total",
+		"Block gets received from peers.", []string{"group"}, nil)
+	groupCacheBytesDesc = prometheus.NewDesc("tigerbat_groupcache_cache_bytes",
+		"Bytes held in memory.", []string{"group", "cache"}, nil)
+	groupCacheItemsDesc = prometheus.NewDesc("tigerbat_groupcache_cache_items",
+		"Blocks held in memory.", []string{"group", "cache"}, nil)
+	groupCacheEvictionsDesc = prometheus.NewDesc("tigerbat_groupcache_cache_evictions_total",
+		"Blocks evicted from memory.", []string{"group", "cache"}, nil)
+)
+
+func (c *groupCollector) add(group *groupcache.Group) {
+	c.lock.Lock()
+	c.groups = append(c.groups, group)
+	c.lock.Unlock()
+}
+
+func (c *groupCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- groupGetsDesc
+	ch <- groupHitsDesc
+	ch <- groupPeerLoadsDesc
+	ch <- groupPeerErrorsDesc
+	ch <- groupLocalLoadsDesc
+	ch <- groupLocalLoadErrorsDesc
+	ch <- groupServerRequestsDesc
+	ch <- groupCacheBytesDesc
+	ch <- groupCacheItemsDesc
+	ch <- groupCacheEvictionsDesc
+}
+
+func (c *groupCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, group := range c.groups {
+		name := group.Name()
+		stats := &group.Stats
+		counter := func(desc *prometheus.Desc, value *groupcache.AtomicInt) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value.Get()), name)
+		}
+		counter(groupGetsDesc, &stats.Gets)
+		counter(groupHitsDesc, &stats.CacheHits)
+		counter(groupPeerLoadsDesc, &stats.PeerLoads)
+		counter(groupPeerErrorsDesc, &stats.PeerErrors)
+		counter(groupLocalLoadsDesc, &stats.LocalLoads)
+		counter(groupLocalLoadErrorsDesc, &stats.LocalLoadErrs)
+		counter(groupServerRequestsDesc, &stats.ServerRequests)
+
+		for cache, cacheType := range map[string]groupcache.CacheType{"main": groupcache.MainCache, "hot": groupcache.HotCache} {
+			cacheStats := group.CacheStats(cacheType)
+			ch <- prometheus.MustNewConstMetric(groupCacheBytesDesc, prometheus.GaugeValue, float64(cacheStats.Bytes), name, cache)
+			ch <- prometheus.MustNewConstMetric(groupCacheItemsDesc, prometheus.GaugeValue, float64(cacheStats.Items), name, cache)
+			ch <- prometheus.MustNewConstMetric(groupCacheEvictionsDesc, prometheus.CounterValue, float64(cacheStats.Evictions), name, cache)
+		}
+	}
+}
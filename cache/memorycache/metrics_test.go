@@ -0,0 +1,77 @@
+package gcache
+
+import (
+	"github.com/fkautz/tigerbat/cache/hydrator"
+	"github.com/golang/groupcache"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"golang.org/x/net/context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMetadataLookupMetrics(t *testing.T) {
+	tests := []struct {
+		result string
+		entry  *hydrator.CacheEntry
+	}{
+		{"hit", expiredEntry(-time.Hour)},
+		{"stale", staleEntry()},
+		{"miss", nil},
+	}
+	for _, test := range tests {
+		upstream := new(testHydrator)
+		upstream.On("GetMetadata", "foo", mock.Anything).Return(expiredEntry(-time.Hour), nil)
+		upstream.On("Revalidate", "foo", mock.Anything).Return(expiredEntry(-time.Hour), nil)
+		mc := metadataTestCache(upstream, test.entry)
+		before := testutil.ToFloat64(metadataLookups.WithLabelValues(test.result))
+
+		_, err := mc.GetMetadata(context.Background(), "foo", http.Header{})
+		assert.Nil(t, err, test.result)
+		assert.Equal(t, before+1, testutil.ToFloat64(metadataLookups.WithLabelValues(test.result)), test.result)
+		assert.Eventually(t, func() bool {
+			mc.revalidatingLock.Lock()
+			defer mc.revalidatingLock.Unlock()
+			return len(mc.revalidating) == 0
+		}, time.Second, time.Millisecond, test.result)
+	}
+}
+
+// staleEntry returns an entry that may be served while it is revalidated.
+func staleEntry() *hydrator.CacheEntry {
+	cacheEntry := expiredEntry(time.Second)
+	cacheEntry.StaleWhileRevalidate = time.Minute
+	return cacheEntry
+}
+
+func TestMetadataEntriesMetric(t *testing.T) {
+	cache := NewMetadataCache().(*metadataCache)
+	cache.AddSync(nopSyncer{})
+	cache.AddWithoutSync("http://a/x", hydrator.CacheEntry{})
+	cache.AddWithoutSync("http://a/y", hydrator.CacheEntry{})
+	assert.Equal(t, float64(2), testutil.ToFloat64(metadataEntries))
+	assert.Nil(t, cache.Remove("http://a/x"))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metadataEntries))
+}
+
+func TestGroupCollector(t *testing.T) {
+	collector := &groupCollector{}
+	assert.Equal(t, 0, testutil.CollectAndCount(collector))
+	// groups can't be registered twice, reuse the one of an earlier run
+	group := groupcache.GetGroup("testmetrics")
+	if group == nil {
+		group = groupcache.NewGroup("testmetrics", 1<<20, groupcache.GetterFunc(func(ctx groupcache.Context, key string, dest groupcache.Sink) error {
+			return dest.SetBytes([]byte(key))
+		}))
+	}
+	collector.add(group)
+
+	var data []byte
+	assert.Nil(t, group.Get(nil, "a", groupcache.AllocatingByteSliceSink(&data)))
+	assert.Nil(t, group.Get(nil, "a", groupcache.AllocatingByteSliceSink(&data)))
+	// seven counters, and three metrics for each of the two caches
+	assert.Equal(t, 13, testutil.CollectAndCount(collector))
+	assert.Equal(t, 2, testutil.CollectAndCount(collector, "tigerbat_groupcache_cache_items"))
+}
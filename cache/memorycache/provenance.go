@@ -0,0 +1,180 @@
+package gcache
+
+import (
+	"github.com/fkautz/tigerbat/cache/accesslog"
+	"github.com/fkautz/tigerbat/cache/hydrator"
+	"github.com/golang/groupcache"
+	"golang.org/x/net/context"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// tierHeader carries the tiers a peer served a block from,
+// upstreamBytesHeader how much of it the peer fetched from the upstream.
+// abandonedHeader is set when a peer failed a block because everyone else
+// waiting for it went away, the request may be sent again.
+const (
+	tierHeader          = "X-Cache-Tier"
+	upstreamBytesHeader = "X-Cache-Upstream-Bytes"
+	abandonedHeader     = "X-Cache-Abandoned"
+)
+
+// maxAbandonedRetries is how often a block is asked for again from a peer
+// that abandoned loading it.
+const maxAbandonedRetries = 2
+
+// tierPath collects the tiers a single block goes through. An empty path
+// means groupcache had the block in memory.
+type tierPath struct {
+	tiers         []string
+	upstreamBytes int64
+}
+
+func (t *tierPath) add(tier string) {
+	if t != nil {
+		t.tiers = append(t.tiers, tier)
+	}
+}
+
+func (t *tierPath) addUpstreamBytes(n int64) {
+	if t != nil {
+		t.upstreamBytes += n
+	}
+}
+
+func (t *tierPath) String() string {
+	if len(t.tiers) == 0 {
+		return hydrator.TierMemory
+	}
+	return strings.Join(t.tiers, ",")
+}
+
+// peerTransport records the peers blocks are loaded from, along with the
+// tiers they reported, and passes the request ID on to them. Requests are
+// canceled along with the load.
+type peerTransport struct {
+	ctx       context.Context
+	tiers     *tierPath
+	requestID string
+}
+
+func newPeerTransport(ctx groupcache.Context) http.RoundTripper {
+	typedCtx, _ := ctx.(cacheContext)
+	return peerTransport{ctx: typedCtx.ctx, tiers: typedCtx.tiers, requestID: typedCtx.requestID}
+}
+
+func (t peerTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if t.ctx != nil {
+		request = request.WithContext(t.ctx)
+	}
+	if t.requestID != "" {
+		withID := *request
+		withID.Header = make(http.Header, len(request.Header)+1)
+		for k, v := range request.Header {
+			withID.Header[k] = v
+		}
+		withID.Header.Set(accesslog.RequestIDHeader, t.requestID)
+		request = &withID
+	}
+	response, err := http.DefaultTransport.RoundTrip(request)
+	for retries := 0; err == nil && response.Header.Get(abandonedHeader) != "" && retries < maxAbandonedRetries; retries++ {
+		if t.ctx != nil && t.ctx.Err() != nil {
+			break
+		}
+		response.Body.Close()
+		response, err = http.DefaultTransport.RoundTrip(request)
+	}
+	if err != nil || response.StatusCode != http.StatusOK {
+		peerFetches.WithLabelValues("error").Inc()
+	} else {
+		peerFetches.WithLabelValues("ok").Inc()
+		t.tiers.add(hydrator.TierPeer + "=" + request.URL.Host)
+		if peerTiers := response.Header.Get(tierHeader); peerTiers != "" {
+			t.tiers.add(peerTiers)
+		}
+		if n, err := strconv.ParseInt(response.Header.Get(upstreamBytesHeader), 10, 64); err == nil {
+			t.tiers.addUpstreamBytes(n)
+		}
+	}
+	return response, err
+}
+
+type tierPathContextKey struct{}
+type loadContextKey struct{}
+
+// peerBasePath is where groupcache serves peers, blocks are requested at
+// peerBasePath + group + "/" + key.
+const peerBasePath = "/_groupcache/"
+
+// reportTiers wraps the peer handler to tell the requesting peer which tiers
+// served the block. The block is loaded for as long as any peer or local
+// client waits for it.
+func reportTiers(peers http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tiers := &tierPath{}
+		ctx := context.WithValue(r.Context(), tierPathContextKey{}, tiers)
+		writer := &tierHeaderWriter{ResponseWriter: w, tiers: tiers, ctx: r.Context()}
+		if parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, peerBasePath), "/", 2); len(parts) == 2 {
+			// the same key groupcache loads the block under
+			loadCtx, done := fills.wait(r.Context(), parts[0]+"/"+parts[1])
+			defer done()
+			ctx = context.WithValue(ctx, loadContextKey{}, loadCtx)
+		}
+		peers.ServeHTTP(writer, r.WithContext(ctx))
+		writer.flush()
+		if entry := accesslog.FromRequest(r); entry != nil {
+			entry.UpstreamBytes = tiers.upstreamBytes
+		}
+	})
+}
+
+// tierHeaderWriter sets the tier header once the block has been loaded, just
+// before the response is written. The status of a failed load is held back
+// until its error shows whether the load was abandoned.
+type tierHeaderWriter struct {
+	http.ResponseWriter
+	tiers       *tierPath
+	wroteHeader bool
+	failed      int
+	// ctx is the request's, still waiting for the block unless done
+	ctx context.Context
+}
+
+func (w *tierHeaderWriter) WriteHeader(code int) {
+	if code != http.StatusOK && !w.wroteHeader && w.failed == 0 {
+		w.failed = code
+		return
+	}
+	w.writeHeader(code)
+}
+
+func (w *tierHeaderWriter) writeHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Set(tierHeader, w.tiers.String())
+		w.Header().Set(upstreamBytesHeader, strconv.FormatInt(w.tiers.upstreamBytes, 10))
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *tierHeaderWriter) Write(p []byte) (int, error) {
+	if w.failed != 0 && !w.wroteHeader {
+		// groupcache answers with the error the load failed with
+		if strings.HasSuffix(strings.TrimSpace(string(p)), context.Canceled.Error()) && w.ctx != nil && w.ctx.Err() == nil {
+			w.Header().Set(abandonedHeader, "1")
+		}
+		w.writeHeader(w.failed)
+	}
+	if !w.wroteHeader {
+		w.writeHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// flush writes a status held back by a failure without a body.
+func (w *tierHeaderWriter) flush() {
+	if w.failed != 0 && !w.wroteHeader {
+		w.writeHeader(w.failed)
+	}
+}
@@ -0,0 +1,69 @@
+package gcache
+
+import (
+	"errors"
+	"github.com/fkautz/tigerbat/cache/hydrator"
+	"time"
+)
+
+// pingInterval is how long the upstream's answer to a ping is reused for.
+const pingInterval = 10 * time.Second
+
+// Status runs the readiness checks: the node isn't leaving, the etcd watch
+// is established, a peer is known, the disk cache is usable and the
+// upstream answers.
+func (mc *memoryCache) Status() *hydrator.Status {
+	self, peers, leaving := currentPeers()
+	status := &hydrator.Status{
+		Self:   self,
+		Role:   hydrator.RoleJoining,
+		Peers:  peers,
+		Ready:  true,
+		Checks: make(map[string]string),
+	}
+	for _, peer := range peers {
+		if peer == self {
+			status.Role = hydrator.RoleMember
+		}
+	}
+
+	check := func(name string, err error) {
+		if err != nil {
+			status.Checks[name] = err.Error()
+			status.Ready = false
+		} else {
+			status.Checks[name] = "ok"
+		}
+	}
+	if leaving {
+		status.Role = hydrator.RoleLeaving
+		check("leaving", errors.New("Shutting down"))
+	}
+	if !mc.metadata.Syncing() {
+		check("etcd", errors.New("Metadata watch not established"))
+	} else {
+		check("etcd", nil)
+	}
+	if len(peers) == 0 {
+		check("peers", errors.New("No peers known"))
+	} else {
+		check("peers", nil)
+	}
+	if mc.diskCache != nil {
+		check("disk", mc.diskCache.Check())
+	}
+	check("upstream", mc.ping())
+	return status
+}
+
+// ping pings the upstream at most once every pingInterval, however often
+// the status is asked for.
+func (mc *memoryCache) ping() error {
+	mc.pingLock.Lock()
+	defer mc.pingLock.Unlock()
+	if time.Since(mc.pinged) >= pingInterval {
+		mc.pingErr = mc.hydrator.Ping()
+		mc.pinged = time.Now()
+	}
+	return mc.pingErr
+}
@@ -0,0 +1,48 @@
+package gcache
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// watchingSyncer reports an established watch without talking to etcd.
+type watchingSyncer struct {
+	MetadataSyncer
+}
+
+func (watchingSyncer) Watching() bool {
+	return true
+}
+
+func TestStatusUpstreamDown(t *testing.T) {
+	setPeers([]string{"http://10.0.0.1:8000"})
+	defer setPeers(nil)
+	metadata := NewMetadataCache()
+	metadata.(*metadataCache).AddSync(watchingSyncer{})
+	upstream := new(testHydrator)
+	upstream.On("Ping").Return(errors.New("connection refused"))
+	mc := &memoryCache{metadata: metadata, hydrator: upstream}
+
+	status := mc.Status()
+	assert.False(t, status.Ready)
+	assert.Equal(t, "connection refused", status.Checks["upstream"])
+	assert.Equal(t, "ok", status.Checks["etcd"])
+	assert.Equal(t, "ok", status.Checks["peers"])
+
+	// probes in between reuse the last answer
+	mc.Status()
+	upstream.AssertNumberOfCalls(t, "Ping", 1)
+}
+
+func TestStatusNotReady(t *testing.T) {
+	upstream := new(testHydrator)
+	upstream.On("Ping").Return(nil)
+	mc := &memoryCache{metadata: NewMetadataCache(), hydrator: upstream}
+
+	status := mc.Status()
+	assert.False(t, status.Ready)
+	assert.Equal(t, "Metadata watch not established", status.Checks["etcd"])
+	assert.Equal(t, "No peers known", status.Checks["peers"])
+	assert.Equal(t, "ok", status.Checks["upstream"])
+}
@@ -0,0 +1,182 @@
+package gcache
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"io"
+	"sync"
+)
+
+// streamFill is a block this node is loading from the upstream. Readers here
+// read it as it arrives instead of waiting for groupcache to have all of it.
+// Readers on other nodes get the block from groupcache once it is complete.
+// The hydrator writes it from the start, retries write again from the start
+// and only what goes past the bytes already there is kept.
+type streamFill struct {
+	lock   sync.Mutex
+	data   []byte
+	filled int64
+	// changed is closed and replaced whenever bytes arrive or the fill ends
+	changed chan struct{}
+	done    bool
+	err     error
+}
+
+var errStreamGap = errors.New("Stream written out of order")
+
+// streams are the block fills in flight on this node, by disk key. Readers
+// waiting for a fill of a key to start are woken through waiting.
+var streams = struct {
+	lock    sync.Mutex
+	fills   map[string]*streamFill
+	waiting map[string]*streamWatch
+}{fills: make(map[string]*streamFill), waiting: make(map[string]*streamWatch)}
+
+// streamWatch is closed once a fill of its key starts.
+type streamWatch struct {
+	started  chan struct{}
+	watchers int
+}
+
+// startStream registers the fill of a block of size bytes under key. The
+// returned function removes it again.
+func startStream(key string, size int64) (*streamFill, func()) {
+	fill := &streamFill{
+		data:    make([]byte, size),
+		changed: make(chan struct{}),
+	}
+	streams.lock.Lock()
+	streams.fills[key] = fill
+	if watch := streams.waiting[key]; watch != nil {
+		close(watch.started)
+		delete(streams.waiting, key)
+	}
+	streams.lock.Unlock()
+	return fill, func() {
+		streams.lock.Lock()
+		if streams.fills[key] == fill {
+			delete(streams.fills, key)
+		}
+		streams.lock.Unlock()
+	}
+}
+
+// watchStream returns the fill of key in flight on this node. If there is
+// none, it returns a channel closed once one starts instead, and stop must
+// be called when done waiting for it.
+func watchStream(key string) (fill *streamFill, started <-chan struct{}, stop func()) {
+	streams.lock.Lock()
+	defer streams.lock.Unlock()
+	if fill := streams.fills[key]; fill != nil {
+		return fill, nil, func() {}
+	}
+	watch := streams.waiting[key]
+	if watch == nil {
+		watch = &streamWatch{started: make(chan struct{})}
+		streams.waiting[key] = watch
+	}
+	watch.watchers++
+	return nil, watch.started, func() {
+		streams.lock.Lock()
+		defer streams.lock.Unlock()
+		watch.watchers--
+		if watch.watchers == 0 && streams.waiting[key] == watch {
+			delete(streams.waiting, key)
+		}
+	}
+}
+
+func (fill *streamFill) WriteAt(p []byte, off int64) (int, error) {
+	fill.lock.Lock()
+	defer fill.lock.Unlock()
+	if off > fill.filled {
+		return 0, errStreamGap
+	}
+	// bytes before filled may be read by now, they are left alone
+	if end := off + int64(len(p)); end > fill.filled {
+		copy(fill.data[fill.filled:], p[fill.filled-off:])
+		fill.filled = end
+		fill.broadcast()
+	}
+	return len(p), nil
+}
+
+// finish ends the fill, readers still waiting get err if it isn't nil.
+func (fill *streamFill) finish(err error) {
+	fill.lock.Lock()
+	defer fill.lock.Unlock()
+	fill.done = true
+	fill.err = err
+	fill.broadcast()
+}
+
+// broadcast wakes up the readers, fill.lock must be held.
+func (fill *streamFill) broadcast() {
+	close(fill.changed)
+	fill.changed = make(chan struct{})
+}
+
+// complete reports whether all of the block arrived.
+func (fill *streamFill) complete() bool {
+	fill.lock.Lock()
+	defer fill.lock.Unlock()
+	return fill.done && fill.err == nil
+}
+
+// wait returns the bytes that arrived once more than from did, or the fill
+// ended.
+func (fill *streamFill) wait(ctx context.Context, from int64) ([]byte, error) {
+	for {
+		fill.lock.Lock()
+		filled, done, err, changed := fill.filled, fill.done, fill.err, fill.changed
+		fill.lock.Unlock()
+		switch {
+		case err != nil:
+			return nil, err
+		case filled > from || done:
+			return fill.data[:filled], nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// readAt fills p from off once those bytes arrived.
+func (fill *streamFill) readAt(ctx context.Context, p []byte, off int64) (int, error) {
+	end := off + int64(len(p))
+	data, err := fill.wait(ctx, end-1)
+	if err != nil {
+		return 0, err
+	}
+	if int64(len(data)) < end {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return copy(p, data[off:end]), nil
+}
+
+// writeTo writes the bytes from off up to end to w as they arrive. The
+// bytes written are reported even when the fill failed.
+func (fill *streamFill) writeTo(ctx context.Context, w io.Writer, off, end int64) (int64, error) {
+	pos := off
+	for pos < end {
+		data, err := fill.wait(ctx, pos)
+		if err != nil {
+			return pos - off, err
+		}
+		if int64(len(data)) <= pos {
+			return pos - off, io.ErrUnexpectedEOF
+		}
+		if int64(len(data)) > end {
+			data = data[:end]
+		}
+		n, err := w.Write(data[pos:])
+		pos += int64(n)
+		if err != nil {
+			return pos - off, err
+		}
+	}
+	return pos - off, nil
+}
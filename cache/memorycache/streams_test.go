@@ -0,0 +1,105 @@
+package gcache
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestStreamFillWrites(t *testing.T) {
+	fill, stop := startStream("writes", 6)
+	defer stop()
+
+	n, err := fill.WriteAt([]byte("012"), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	// a retry writes from the start again, only the new bytes count
+	_, err = fill.WriteAt([]byte("0xx3"), 0)
+	assert.Nil(t, err)
+	_, err = fill.WriteAt([]byte("5"), 5)
+	assert.Equal(t, errStreamGap, err)
+
+	p := make([]byte, 2)
+	n, err = fill.readAt(context.Background(), p, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "23", string(p[:n]))
+	assert.False(t, fill.complete())
+}
+
+func TestStreamFillReadersFollow(t *testing.T) {
+	fill, stop := startStream("follow", 6)
+	defer stop()
+
+	var out bytes.Buffer
+	written := make(chan error)
+	go func() {
+		_, err := fill.writeTo(context.Background(), &out, 1, 5)
+		written <- err
+	}()
+	fill.WriteAt([]byte("012"), 0)
+	fill.WriteAt([]byte("345"), 3)
+	fill.finish(nil)
+	assert.Nil(t, <-written)
+	assert.Equal(t, "1234", out.String())
+	assert.True(t, fill.complete())
+}
+
+func TestStreamFillFailures(t *testing.T) {
+	failed := errors.New("upstream failed")
+	fill, stop := startStream("failures", 6)
+	defer stop()
+	fill.WriteAt([]byte("01"), 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := fill.readAt(ctx, make([]byte, 2), 2)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	fill.finish(failed)
+	var out bytes.Buffer
+	n, err := fill.writeTo(context.Background(), &out, 0, 6)
+	assert.Equal(t, failed, err)
+	assert.Equal(t, int64(0), n)
+	assert.False(t, fill.complete())
+
+	short, stop := startStream("short", 6)
+	defer stop()
+	short.WriteAt([]byte("01"), 0)
+	short.finish(nil)
+	n, err = short.writeTo(context.Background(), &out, 0, 6)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, int64(2), n)
+}
+
+func TestWatchStream(t *testing.T) {
+	fill, started, stopWatching := watchStream("watched")
+	assert.Nil(t, fill)
+	_, other, stopOther := watchStream("other")
+
+	// only readers of the key are woken
+	_, stop := startStream("watched", 1)
+	defer stop()
+	select {
+	case <-started:
+	default:
+		t.Error("watcher not woken")
+	}
+	select {
+	case <-other:
+		t.Error("watcher of another key woken")
+	default:
+	}
+	stopWatching()
+
+	fill, _, _ = watchStream("watched")
+	assert.NotNil(t, fill)
+
+	stopOther()
+	streams.lock.Lock()
+	assert.Nil(t, streams.waiting["other"])
+	streams.lock.Unlock()
+}
@@ -0,0 +1,299 @@
+package gcache
+
+import (
+	"bytes"
+	"errors"
+	"github.com/fkautz/tigerbat/cache/hydrator"
+	"github.com/fkautz/tigerbat/cache/logger"
+	"golang.org/x/net/context"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wholePrefix marks the keys of blocks of objects fetched whole. It is
+// followed by the object's key, so that peerHash sends all of its blocks to
+// the same peer and the object is only fetched once.
+const wholePrefix = "whole/"
+
+func wholeKey(request dataRequest, jsonDataRequest []byte) string {
+	return wholePrefix + request.Key + "/" + string(jsonDataRequest)
+}
+
+// peerHash picks the peer owning a key. Blocks of objects fetched whole are
+// placed by their object alone.
+func peerHash(key []byte) uint32 {
+	if bytes.HasPrefix(key, []byte(wholePrefix)) {
+		if end := bytes.IndexByte(key[len(wholePrefix):], '/'); end >= 0 {
+			key = key[:len(wholePrefix)+end]
+		}
+	}
+	return crc32.ChecksumIEEE(key)
+}
+
+// wholeFill streams an object from an upstream that ignores Range once. Its
+// blocks go to the disk cache as they arrive, requests for any of them wait
+// on the same fill. Readers ask for one block after the other, so the fill
+// keeps going between requests and is only abandoned when the last request
+// waiting for a block goes away.
+type wholeFill struct {
+	lock    sync.Mutex
+	cancel  context.CancelFunc
+	waiting int
+	// wanted counts the requests waiting for each block
+	wanted map[int64]int
+	// arrived blocks are on disk. Blocks the disk cache refused are kept
+	// until they are handed out, gone once they were, or were dropped.
+	arrived map[int64]bool
+	kept    map[int64][]byte
+	gone    map[int64]bool
+	// changed is closed and replaced whenever a block arrives or the fill
+	// ends
+	changed chan struct{}
+	done    bool
+	err     error
+	// size is how much of the object arrived so far
+	size int64
+	// keptTimeout as the fill started
+	keptTimeout time.Duration
+}
+
+// Without the disk cache, up to maxKept blocks are held ahead of the readers.
+// The fill waits for them to be taken, dropping the ones nobody asked for
+// after keptTimeout.
+const maxKept = 4
+
+var keptTimeout = 30 * time.Second
+
+var wholeFills = struct {
+	lock  sync.Mutex
+	fills map[string]*wholeFill
+}{fills: make(map[string]*wholeFill)}
+
+// loadWhole returns block info.Block of an object fetched whole, starting
+// the fill unless one is running already that can still deliver the block.
+func loadWhole(typedCtx cacheContext, info dataRequest) ([]byte, error) {
+	wholeFills.lock.Lock()
+	fill := wholeFills.fills[info.Key]
+	if fill != nil {
+		fill.lock.Lock()
+		if fill.gone[info.Block] {
+			// the running fill goes on for its readers
+			fill.lock.Unlock()
+			fill = nil
+		} else {
+			fill.waiting++
+			fill.wanted[info.Block]++
+			fill.lock.Unlock()
+		}
+	}
+	if fill == nil {
+		fill = &wholeFill{
+			waiting: 1,
+			wanted:  map[int64]int{info.Block: 1},
+			arrived: make(map[int64]bool),
+			kept:    make(map[int64][]byte),
+			gone:    make(map[int64]bool),
+			changed: make(chan struct{}),
+
+			keptTimeout: keptTimeout,
+		}
+		var ctx context.Context
+		ctx, fill.cancel = context.WithCancel(context.Background())
+		wholeFills.fills[info.Key] = fill
+		go fill.run(ctx, typedCtx, info)
+	}
+	wholeFills.lock.Unlock()
+
+	return fill.block(typedCtx, info)
+}
+
+func (fill *wholeFill) run(ctx context.Context, typedCtx cacheContext, info dataRequest) {
+	cacheEntry := &hydrator.CacheEntry{
+		Metadata:  info.Headers,
+		Variant:   info.Variant,
+		Location:  typedCtx.location,
+		RequestID: typedCtx.requestID,
+	}
+	err := typedCtx.hydrator.GetWhole(ctx, info.Url, cacheEntry, info.BlockSize, func(index int64, data []byte) error {
+		fill.lock.Lock()
+		_, kept := fill.kept[index]
+		seen := fill.arrived[index] || kept || fill.gone[index]
+		if end := index*info.BlockSize + int64(len(data)); end > fill.size {
+			fill.size = end
+		}
+		fill.lock.Unlock()
+		if seen {
+			return nil
+		}
+		// the block is here, keep it even if nobody waits for it anymore
+		err := typedCtx.diskCache.Put(context.Background(), info.Key+"-"+strconv.FormatInt(index, 10), bytes.NewBuffer(data))
+		if err != nil && !os.IsExist(err) {
+			logger.Debugln("Unable to store block", info.Url, index, err)
+			return fill.keep(ctx, index, data)
+		}
+		fill.lock.Lock()
+		fill.arrived[index] = true
+		fill.broadcast()
+		fill.lock.Unlock()
+		return nil
+	})
+
+	// without a short last block, readers of an object of unknown length
+	// only learn that it ended from an empty one
+	fill.lock.Lock()
+	size := fill.size
+	fill.lock.Unlock()
+	if err == nil && info.Size < 0 && size%info.BlockSize == 0 {
+		index := size / info.BlockSize
+		putErr := typedCtx.diskCache.Put(context.Background(), info.Key+"-"+strconv.FormatInt(index, 10), bytes.NewBuffer(nil))
+		fill.lock.Lock()
+		if putErr == nil || os.IsExist(putErr) {
+			fill.arrived[index] = true
+		} else {
+			fill.kept[index] = []byte{}
+		}
+		fill.lock.Unlock()
+	}
+
+	fill.lock.Lock()
+	fill.done = true
+	fill.err = err
+	fill.broadcast()
+	lingering := err == nil && len(fill.kept) > 0
+	fill.lock.Unlock()
+	fill.cancel()
+	if lingering {
+		// the blocks still kept are handed out for a while
+		time.AfterFunc(fill.keptTimeout, func() {
+			fill.unregister(info.Key)
+		})
+		return
+	}
+	fill.unregister(info.Key)
+}
+
+// unregister lets the next request for key start a new fill.
+func (fill *wholeFill) unregister(key string) {
+	wholeFills.lock.Lock()
+	if wholeFills.fills[key] == fill {
+		delete(wholeFills.fills, key)
+	}
+	wholeFills.lock.Unlock()
+}
+
+// keep holds a block the disk cache refused until a request takes it. While
+// maxKept blocks are held already, it waits for room unless the block is
+// wanted right away.
+func (fill *wholeFill) keep(ctx context.Context, index int64, data []byte) error {
+	fill.lock.Lock()
+	defer fill.lock.Unlock()
+	timeout := time.After(fill.keptTimeout)
+	for len(fill.kept) >= maxKept && fill.wanted[index] == 0 {
+		changed := fill.changed
+		fill.lock.Unlock()
+		expired := false
+		select {
+		case <-changed:
+		case <-timeout:
+			expired = true
+		case <-ctx.Done():
+		}
+		fill.lock.Lock()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if expired {
+			// whoever asks for these later fetches the object again
+			for held := range fill.kept {
+				if fill.wanted[held] == 0 {
+					delete(fill.kept, held)
+					fill.gone[held] = true
+				}
+			}
+			timeout = time.After(fill.keptTimeout)
+		}
+	}
+	fill.kept[index] = data
+	fill.broadcast()
+	return nil
+}
+
+// broadcast wakes up the requests waiting for blocks, fill.lock must be held.
+func (fill *wholeFill) broadcast() {
+	close(fill.changed)
+	fill.changed = make(chan struct{})
+}
+
+func (fill *wholeFill) block(typedCtx cacheContext, info dataRequest) ([]byte, error) {
+	abandoned := false
+	taken := false
+	defer func() {
+		fill.lock.Lock()
+		fill.waiting--
+		fill.wanted[info.Block]--
+		if fill.wanted[info.Block] == 0 {
+			delete(fill.wanted, info.Block)
+		}
+		if abandoned && fill.waiting == 0 {
+			fill.cancel()
+		}
+		finished := fill.done && len(fill.kept) == 0
+		fill.lock.Unlock()
+		if taken && finished {
+			fill.unregister(info.Key)
+		}
+	}()
+	for {
+		fill.lock.Lock()
+		data, kept := fill.kept[info.Block]
+		if kept {
+			// groupcache holds on to it from here, the fill can go on
+			delete(fill.kept, info.Block)
+			fill.gone[info.Block] = true
+			fill.broadcast()
+			taken = true
+		}
+		arrived := fill.arrived[info.Block]
+		done, err := fill.done, fill.err
+		changed := fill.changed
+		fill.lock.Unlock()
+
+		switch {
+		case kept:
+			return data, nil
+		case arrived:
+			reader, err := typedCtx.diskCache.Get(typedCtx.ctx, info.Key+"-"+strconv.FormatInt(info.Block, 10))
+			if err != nil {
+				return nil, err
+			}
+			defer reader.Close()
+			return ioutil.ReadAll(reader)
+		case done && err != nil:
+			return nil, err
+		case done:
+			return nil, errors.New("Block " + strconv.FormatInt(info.Block, 10) + " is not part of " + info.Url)
+		}
+
+		select {
+		case <-changed:
+		case <-typedCtx.ctx.Done():
+			abandoned = true
+			return nil, typedCtx.ctx.Err()
+		}
+	}
+}
+
+// routedKey strips the routing prefix off the key of a block of an object
+// fetched whole.
+func routedKey(key string) string {
+	if !strings.HasPrefix(key, wholePrefix) {
+		return key
+	}
+	rest := key[len(wholePrefix):]
+	return "data/" + rest[strings.Index(rest, "/")+1:]
+}
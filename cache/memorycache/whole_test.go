@@ -0,0 +1,152 @@
+package gcache
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/fkautz/tigerbat/cache/hydrator"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// wholeHydrator serves data whole, counting the fetches.
+type wholeHydrator struct {
+	testHydrator
+	data    string
+	fetches int32
+}
+
+func (h *wholeHydrator) GetWhole(ctx context.Context, url string, cacheEntry *hydrator.CacheEntry, blockSize int64, block func(index int64, data []byte) error) error {
+	atomic.AddInt32(&h.fetches, 1)
+	for index := int64(0); index*blockSize < int64(len(h.data)); index++ {
+		end := (index + 1) * blockSize
+		if end > int64(len(h.data)) {
+			end = int64(len(h.data))
+		}
+		if err := block(index, []byte(h.data[index*blockSize:end])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memoryDisk is a disk cache in memory, refusing every block if full is set.
+type memoryDisk struct {
+	testDiskCache
+	lock   sync.Mutex
+	blocks map[string][]byte
+	full   bool
+}
+
+func (d *memoryDisk) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	data, ok := d.blocks[key]
+	if !ok {
+		return nil, errors.New("Not Found")
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (d *memoryDisk) Put(ctx context.Context, key string, data io.Reader) error {
+	if d.full {
+		return errors.New("Disk full")
+	}
+	buf, err := ioutil.ReadAll(data)
+	d.lock.Lock()
+	d.blocks[key] = buf
+	d.lock.Unlock()
+	return err
+}
+
+func wholeRequest(key string, block int64) dataRequest {
+	return dataRequest{
+		MetadataRequest: MetadataRequest{Url: "foo", Key: key},
+		Block:           block,
+		Size:            10,
+		BlockSize:       1,
+		Whole:           true,
+	}
+}
+
+func TestWholeKeyRouting(t *testing.T) {
+	first, err := wholeRequest("object", 0).groupKey()
+	assert.Nil(t, err)
+	last, err := wholeRequest("object", 9).groupKey()
+	assert.Nil(t, err)
+	other, err := wholeRequest("other", 0).groupKey()
+	assert.Nil(t, err)
+
+	assert.Equal(t, peerHash([]byte(first)), peerHash([]byte(last)))
+	assert.NotEqual(t, peerHash([]byte(first)), peerHash([]byte(other)))
+
+	jsonDataRequest, _ := json.Marshal(wholeRequest("object", 9))
+	assert.Equal(t, "data/"+string(jsonDataRequest), routedKey(last))
+	assert.Equal(t, "data/x", routedKey("data/x"))
+}
+
+func TestLoadWholeStoresBlocks(t *testing.T) {
+	upstream := &wholeHydrator{data: "0123456789"}
+	disk := &memoryDisk{blocks: make(map[string][]byte)}
+	ctx := cacheContext{ctx: context.Background(), hydrator: upstream, diskCache: disk}
+
+	data, err := loadWhole(ctx, wholeRequest("stored", 3))
+	assert.Nil(t, err)
+	assert.Equal(t, "3", string(data))
+	assert.Eventually(t, func() bool {
+		disk.lock.Lock()
+		defer disk.lock.Unlock()
+		return len(disk.blocks) == 10
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&upstream.fetches))
+}
+
+func TestLoadWholeKeepsRefusedBlocks(t *testing.T) {
+	upstream := &wholeHydrator{data: "0123456789"}
+	disk := &memoryDisk{blocks: make(map[string][]byte), full: true}
+	ctx := cacheContext{ctx: context.Background(), hydrator: upstream, diskCache: disk}
+
+	// the fill waits for the reader instead of holding the whole object
+	for block := int64(0); block < 10; block++ {
+		data, err := loadWhole(ctx, wholeRequest("refused", block))
+		assert.Nil(t, err)
+		assert.Equal(t, string(upstream.data[block]), string(data))
+
+		wholeFills.lock.Lock()
+		if fill := wholeFills.fills["refused"]; fill != nil {
+			fill.lock.Lock()
+			assert.True(t, len(fill.kept) <= maxKept)
+			fill.lock.Unlock()
+		}
+		wholeFills.lock.Unlock()
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&upstream.fetches))
+
+	// a block handed out before is fetched again
+	data, err := loadWhole(ctx, wholeRequest("refused", 0))
+	assert.Nil(t, err)
+	assert.Equal(t, "0", string(data))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&upstream.fetches))
+}
+
+func TestLoadWholeDropsUntakenBlocks(t *testing.T) {
+	defer func(timeout time.Duration) { keptTimeout = timeout }(keptTimeout)
+	keptTimeout = 10 * time.Millisecond
+	upstream := &wholeHydrator{data: "0123456789"}
+	disk := &memoryDisk{blocks: make(map[string][]byte), full: true}
+	ctx := cacheContext{ctx: context.Background(), hydrator: upstream, diskCache: disk}
+
+	// nobody reads blocks 1 to 8, the fill still gets to the last one
+	data, err := loadWhole(ctx, wholeRequest("dropped", 0))
+	assert.Nil(t, err)
+	assert.Equal(t, "0", string(data))
+	data, err = loadWhole(ctx, wholeRequest("dropped", 9))
+	assert.Nil(t, err)
+	assert.Equal(t, "9", string(data))
+}
@@ -13,6 +13,12 @@ type SizeReaderAt interface {
 	io.ReaderAt
 }
 
+// A RangeWriterTo writes n bytes from off on to w, possibly before all of
+// them can be read.
+type RangeWriterTo interface {
+	WriteRangeTo(w io.Writer, off, n int64) (int64, error)
+}
+
 // NewMultiReaderAt is like io.MultiReader but produces a ReaderAt
 // (and Size), instead of just a reader.
 func NewMultiReaderAt(parts ...SizeReaderAt) SizeReaderAt {
@@ -85,6 +91,49 @@ func (m *multi) ReadAt(p []byte, off int64) (n int, err error) {
 	return
 }
 
+// WriteRangeTo writes n bytes from off on to w, part after part. Parts that
+// are RangeWriterTos write themselves, the others are read whole.
+func (m *multi) WriteRangeTo(w io.Writer, off, n int64) (written int64, err error) {
+	end := off + n
+	if end > m.size {
+		end = m.size
+	}
+	for _, part := range m.parts {
+		partEnd := part.off + part.Size()
+		if partEnd <= off || part.off >= end {
+			continue
+		}
+		from := off - part.off
+		if from < 0 {
+			from = 0
+		}
+		to := end - part.off
+		if to > part.Size() {
+			to = part.Size()
+		}
+		var pn int64
+		if rangeWriter, ok := part.SizeReaderAt.(RangeWriterTo); ok {
+			pn, err = rangeWriter.WriteRangeTo(w, from, to-from)
+		} else {
+			buf := make([]byte, to-from)
+			var rn int
+			rn, err = part.ReadAt(buf, from)
+			if err == nil {
+				rn, err = w.Write(buf[:rn])
+			}
+			pn = int64(rn)
+		}
+		written += pn
+		if err != nil {
+			return written, err
+		}
+	}
+	if written != n {
+		err = io.ErrUnexpectedEOF
+	}
+	return written, err
+}
+
 //// NewChunkAlignedReaderAt returns a ReaderAt wrapper that is backed
 //// by a ReaderAt r of size totalSize where the wrapper guarantees that
 //// all ReadAt calls are aligned to chunkSize boundaries and of size
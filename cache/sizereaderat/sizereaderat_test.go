@@ -1 +1,28 @@
 package sizereaderat
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestMultiWriteRangeTo(t *testing.T) {
+	reader := NewMultiReaderAt(
+		io.NewSectionReader(strings.NewReader("0123"), 0, 4),
+		io.NewSectionReader(strings.NewReader("4567"), 0, 4),
+		io.NewSectionReader(strings.NewReader("89"), 0, 2),
+	)
+
+	var out bytes.Buffer
+	n, err := reader.(RangeWriterTo).WriteRangeTo(&out, 2, 7)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), n)
+	assert.Equal(t, "2345678", out.String())
+
+	out.Reset()
+	n, err = reader.(RangeWriterTo).WriteRangeTo(&out, 8, 5)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, "89", out.String())
+}
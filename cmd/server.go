@@ -15,29 +15,61 @@
 package cmd
 
 import (
+	"github.com/fkautz/tigerbat/cache/accesslog"
 	"github.com/fkautz/tigerbat/cache/diskcache"
 	"github.com/fkautz/tigerbat/cache/httpserver"
 	"github.com/fkautz/tigerbat/cache/hydrator"
+	"github.com/fkautz/tigerbat/cache/logger"
 	"github.com/fkautz/tigerbat/cache/memorycache"
 	"github.com/gorilla/mux"
 	"github.com/pivotal-golang/bytefmt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"golang.org/x/net/context"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 )
 
 // flags
 var (
-	address          string
-	cleanedDiskUsage string
-	diskCacheDir     string
-	diskCacheEnabled bool
-	maxDiskUsage     string
-	maxMemoryUsage   string
-	mirrorUrl        string
-	peeringAddress   string
-	etcd             []string
+	address                       string
+	cleanedDiskUsage              string
+	diskCacheDir                  string
+	diskCacheEnabled              bool
+	maxDiskUsage                  string
+	maxMemoryUsage                string
+	mirrorUrl                     string
+	peeringAddress                string
+	etcd                          []string
+	staleGracePeriod              string
+	negativeTTL                   string
+	negativeStatus                []string
+	ignoreClientRevalidation      bool
+	metricsAddress                string
+	adminAddress                  string
+	adminToken                    string
+	drainTimeout                  string
+	accessLog                     string
+	logLevel                      string
+	upstreamMaxConnsPerHost       int
+	upstreamMaxIdleConnsPerHost   int
+	upstreamIdleConnTimeout       string
+	upstreamDialTimeout           string
+	upstreamTLSHandshakeTimeout   string
+	upstreamResponseHeaderTimeout string
+	upstreamHTTP2                 bool
+	upstreamRanges                bool
+	upstreamTLSVerify             bool
+	upstreamCAFile                string
+	upstreamCertFile              string
+	upstreamKeyFile               string
 )
 
 func InitializeConfig(cmd *cobra.Command) {
@@ -50,6 +82,28 @@ func InitializeConfig(cmd *cobra.Command) {
 	viper.SetDefault("mirror-url", "http://localhost:9000")
 	viper.SetDefault("peering-address", "")
 	viper.SetDefault("etcd", "")
+	viper.SetDefault("stale-grace-period", "0s")
+	viper.SetDefault("negative-ttl", "60s")
+	viper.SetDefault("negative-status-codes", []string{"404", "410"})
+	viper.SetDefault("ignore-client-revalidation", false)
+	viper.SetDefault("metrics-address", ":8081")
+	viper.SetDefault("admin-address", "localhost:8082")
+	viper.SetDefault("admin-token", "")
+	viper.SetDefault("drain-timeout", "30s")
+	viper.SetDefault("access-log", "json")
+	viper.SetDefault("log-level", "info")
+	viper.SetDefault("upstream-max-conns-per-host", 0)
+	viper.SetDefault("upstream-max-idle-conns-per-host", 32)
+	viper.SetDefault("upstream-idle-conn-timeout", "90s")
+	viper.SetDefault("upstream-dial-timeout", "10s")
+	viper.SetDefault("upstream-tls-handshake-timeout", "10s")
+	viper.SetDefault("upstream-response-header-timeout", "30s")
+	viper.SetDefault("upstream-http2", true)
+	viper.SetDefault("upstream-ranges", true)
+	viper.SetDefault("upstream-tls-verify", false)
+	viper.SetDefault("upstream-ca-file", "")
+	viper.SetDefault("upstream-cert-file", "")
+	viper.SetDefault("upstream-key-file", "")
 
 	if flagChanged(cmd.PersistentFlags(), "address") {
 		viper.Set("address", address)
@@ -78,6 +132,72 @@ func InitializeConfig(cmd *cobra.Command) {
 	if flagChanged(cmd.PersistentFlags(), "etcd") {
 		viper.Set("etcd", etcd)
 	}
+	if flagChanged(cmd.PersistentFlags(), "stale-grace-period") {
+		viper.Set("stale-grace-period", staleGracePeriod)
+	}
+	if flagChanged(cmd.PersistentFlags(), "negative-ttl") {
+		viper.Set("negative-ttl", negativeTTL)
+	}
+	if flagChanged(cmd.PersistentFlags(), "negative-status-codes") {
+		viper.Set("negative-status-codes", negativeStatus)
+	}
+	if flagChanged(cmd.PersistentFlags(), "ignore-client-revalidation") {
+		viper.Set("ignore-client-revalidation", ignoreClientRevalidation)
+	}
+	if flagChanged(cmd.PersistentFlags(), "metrics-address") {
+		viper.Set("metrics-address", metricsAddress)
+	}
+	if flagChanged(cmd.PersistentFlags(), "admin-address") {
+		viper.Set("admin-address", adminAddress)
+	}
+	if flagChanged(cmd.PersistentFlags(), "admin-token") {
+		viper.Set("admin-token", adminToken)
+	}
+	if flagChanged(cmd.PersistentFlags(), "drain-timeout") {
+		viper.Set("drain-timeout", drainTimeout)
+	}
+	if flagChanged(cmd.PersistentFlags(), "access-log") {
+		viper.Set("access-log", accessLog)
+	}
+	if flagChanged(cmd.PersistentFlags(), "log-level") {
+		viper.Set("log-level", logLevel)
+	}
+	if flagChanged(cmd.PersistentFlags(), "upstream-max-conns-per-host") {
+		viper.Set("upstream-max-conns-per-host", upstreamMaxConnsPerHost)
+	}
+	if flagChanged(cmd.PersistentFlags(), "upstream-max-idle-conns-per-host") {
+		viper.Set("upstream-max-idle-conns-per-host", upstreamMaxIdleConnsPerHost)
+	}
+	if flagChanged(cmd.PersistentFlags(), "upstream-idle-conn-timeout") {
+		viper.Set("upstream-idle-conn-timeout", upstreamIdleConnTimeout)
+	}
+	if flagChanged(cmd.PersistentFlags(), "upstream-dial-timeout") {
+		viper.Set("upstream-dial-timeout", upstreamDialTimeout)
+	}
+	if flagChanged(cmd.PersistentFlags(), "upstream-tls-handshake-timeout") {
+		viper.Set("upstream-tls-handshake-timeout", upstreamTLSHandshakeTimeout)
+	}
+	if flagChanged(cmd.PersistentFlags(), "upstream-response-header-timeout") {
+		viper.Set("upstream-response-header-timeout", upstreamResponseHeaderTimeout)
+	}
+	if flagChanged(cmd.PersistentFlags(), "upstream-http2") {
+		viper.Set("upstream-http2", upstreamHTTP2)
+	}
+	if flagChanged(cmd.PersistentFlags(), "upstream-ranges") {
+		viper.Set("upstream-ranges", upstreamRanges)
+	}
+	if flagChanged(cmd.PersistentFlags(), "upstream-tls-verify") {
+		viper.Set("upstream-tls-verify", upstreamTLSVerify)
+	}
+	if flagChanged(cmd.PersistentFlags(), "upstream-ca-file") {
+		viper.Set("upstream-ca-file", upstreamCAFile)
+	}
+	if flagChanged(cmd.PersistentFlags(), "upstream-cert-file") {
+		viper.Set("upstream-cert-file", upstreamCertFile)
+	}
+	if flagChanged(cmd.PersistentFlags(), "upstream-key-file") {
+		viper.Set("upstream-key-file", upstreamKeyFile)
+	}
 }
 
 // serverCmd represents the server command
@@ -94,6 +214,12 @@ to quickly create a Cobra application.`,
 		log.SetFlags(log.Flags() | log.Lshortfile)
 
 		InitializeConfig(cmd)
+		level, err := logger.ParseLevel(viper.GetString("log-level"))
+		if err != nil {
+			log.Fatalln("Unable to parse log-level", err)
+		}
+		logger.SetLevel(level)
+
 		blockSize := int64(2 * 1024 * 1024)
 
 		var persistentCache diskcache.Cache
@@ -117,18 +243,112 @@ to quickly create a Cobra application.`,
 			log.Fatalln("Unable to parse max-memory-usage", err)
 		}
 
+		staleGrace, err := time.ParseDuration(viper.GetString("stale-grace-period"))
+		if err != nil {
+			log.Fatalln("Unable to parse stale-grace-period", err)
+		}
+
+		drainTimeout, err := time.ParseDuration(viper.GetString("drain-timeout"))
+		if err != nil {
+			log.Fatalln("Unable to parse drain-timeout", err)
+		}
+
+		negativeTTL, err := time.ParseDuration(viper.GetString("negative-ttl"))
+		if err != nil {
+			log.Fatalln("Unable to parse negative-ttl", err)
+		}
+		var negativeStatusCodes []int
+		for _, status := range viper.GetStringSlice("negative-status-codes") {
+			statusCode, err := strconv.Atoi(status)
+			if err != nil {
+				log.Fatalln("Unable to parse negative-status-codes", err)
+			}
+			negativeStatusCodes = append(negativeStatusCodes, statusCode)
+		}
+
+		transportConfig := hydrator.TransportConfig{
+			MaxConnsPerHost:     viper.GetInt("upstream-max-conns-per-host"),
+			MaxIdleConnsPerHost: viper.GetInt("upstream-max-idle-conns-per-host"),
+			HTTP2:               viper.GetBool("upstream-http2"),
+			VerifyTLS:           viper.GetBool("upstream-tls-verify"),
+			CAFile:              viper.GetString("upstream-ca-file"),
+			CertFile:            viper.GetString("upstream-cert-file"),
+			KeyFile:             viper.GetString("upstream-key-file"),
+		}
+		transportConfig.IdleConnTimeout, err = time.ParseDuration(viper.GetString("upstream-idle-conn-timeout"))
+		if err != nil {
+			log.Fatalln("Unable to parse upstream-idle-conn-timeout", err)
+		}
+		transportConfig.DialTimeout, err = time.ParseDuration(viper.GetString("upstream-dial-timeout"))
+		if err != nil {
+			log.Fatalln("Unable to parse upstream-dial-timeout", err)
+		}
+		transportConfig.TLSHandshakeTimeout, err = time.ParseDuration(viper.GetString("upstream-tls-handshake-timeout"))
+		if err != nil {
+			log.Fatalln("Unable to parse upstream-tls-handshake-timeout", err)
+		}
+		transportConfig.ResponseHeaderTimeout, err = time.ParseDuration(viper.GetString("upstream-response-header-timeout"))
+		if err != nil {
+			log.Fatalln("Unable to parse upstream-response-header-timeout", err)
+		}
+		transport, err := hydrator.NewTransport(transportConfig)
+		if err != nil {
+			log.Fatalln("Unable to set up the upstream transport", err)
+		}
+
+		accessLogFormat := viper.GetString("access-log")
+		switch accessLogFormat {
+		case accesslog.FormatJSON, accesslog.FormatCombined, accesslog.FormatOff:
+		default:
+			log.Fatalln("Unable to parse access-log, expected json, combined or off")
+		}
+
 		cacheConfig := gcache.Config{
-			MaxMemoryUsage: int64(maxMemory),
-			BlockSize:      blockSize,
-			DiskCache:      persistentCache,
-			Hydrator:       hydrator.NewHydrator(viper.GetString("mirror-url")),
-			PeeringAddress: viper.GetString("peering-address"),
-			Etcd:           viper.GetStringSlice("etcd"),
+			MaxMemoryUsage:      int64(maxMemory),
+			BlockSize:           blockSize,
+			DiskCache:           persistentCache,
+			Hydrator:            hydrator.NewHydrator(viper.GetString("mirror-url"), transport),
+			PeeringAddress:      viper.GetString("peering-address"),
+			Etcd:                viper.GetStringSlice("etcd"),
+			StaleGracePeriod:    staleGrace,
+			NegativeTTL:         negativeTTL,
+			NegativeStatusCodes: negativeStatusCodes,
+
+			IgnoreClientRevalidation: viper.GetBool("ignore-client-revalidation"),
+			NoUpstreamRanges:         !viper.GetBool("upstream-ranges"),
+			AccessLogFormat:          accessLogFormat,
+			DrainTimeout:             drainTimeout,
 		}
 
 		cache := gcache.NewCache(cacheConfig)
 
-		cacheHandler := httpserver.NewHttpHandler(cache, blockSize)
+		upstream, err := url.Parse(viper.GetString("mirror-url"))
+		if err != nil {
+			log.Fatalln("Unable to parse mirror-url", err)
+		}
+
+		cacheHandler := httpserver.NewHttpHandler(cache, blockSize, upstream, transport)
+
+		if metricsAddress := viper.GetString("metrics-address"); metricsAddress != "" {
+			go func() {
+				metricsRouter := mux.NewRouter()
+				metricsRouter.Handle("/metrics", promhttp.Handler())
+				metricsRouter.PathPrefix("/").Handler(httpserver.NewStatusHandler(cache))
+				if err := http.ListenAndServe(metricsAddress, metricsRouter); err != nil {
+					log.Fatalln("Unable to serve metrics and health checks", err)
+				}
+			}()
+		}
+
+		if adminToken := viper.GetString("admin-token"); adminToken == "" {
+			logger.Warnln("admin-token is not set, the admin API is disabled")
+		} else if adminAddress := viper.GetString("admin-address"); adminAddress != "" {
+			go func() {
+				if err := http.ListenAndServe(adminAddress, httpserver.NewAdminHandler(cache, adminToken)); err != nil {
+					log.Fatalln("Unable to serve admin API", err)
+				}
+			}()
+		}
 
 		router := mux.NewRouter()
 
@@ -139,12 +359,39 @@ to quickly create a Cobra application.`,
 		//err = http.ListenAndServeTLS(address, "cert.pem", "key.pem", router)
 		//handler := lox.NewHandler(lox.NewMemoryCache(), router)
 		var handler http.Handler
-		handler = router
-		//handler = handlers.LoggingHandler(os.Stderr, handler)
-		err = http.ListenAndServe(address, handler)
-		if err != nil {
+		handler = accesslog.NewHandler(router, os.Stdout, accessLogFormat, "client")
+		server := &http.Server{
+			Addr:    address,
+			Handler: handler,
+		}
+
+		// on SIGTERM hand our objects to the peers, then let running
+		// downloads finish before closing the caches
+		stopped := make(chan struct{})
+		go func() {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+			<-signals
+			logger.Infoln("Shutting down, draining for up to", drainTimeout)
+			if err := cache.Leave(); err != nil {
+				logger.Errorln("Unable to leave the cluster", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+			defer cancel()
+			if err := server.Shutdown(ctx); err != nil {
+				logger.Errorln("Unable to drain requests", err)
+			}
+			if err := cache.Shutdown(); err != nil {
+				logger.Errorln("Unable to shut down cache", err)
+			}
+			close(stopped)
+		}()
+
+		err = server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalln(err)
 		}
+		<-stopped
 	},
 }
 
@@ -171,6 +418,28 @@ func init() {
 	serverCmd.PersistentFlags().StringVar(&mirrorUrl, "mirror-url", "http://localhost:9000", "URL root to mirror")
 	serverCmd.PersistentFlags().StringVar(&peeringAddress, "peering-address", "http://localhost:8000", "URL root to mirror")
 	serverCmd.PersistentFlags().StringSliceVar(&etcd, "etcd", []string{}, "URL root to mirror")
+	serverCmd.PersistentFlags().StringVar(&negativeTTL, "negative-ttl", "60s", "How long upstream errors are cached, 0 disables negative caching")
+	serverCmd.PersistentFlags().StringSliceVar(&negativeStatus, "negative-status-codes", []string{"404", "410"}, "Upstream status codes to cache")
+	serverCmd.PersistentFlags().StringVar(&staleGracePeriod, "stale-grace-period", "0s", "How long expired objects may be served while revalidating or when the upstream fails")
+	serverCmd.PersistentFlags().BoolVar(&ignoreClientRevalidation, "ignore-client-revalidation", false, "Ignore client Cache-Control directives that force revalidation")
+	serverCmd.PersistentFlags().StringVar(&metricsAddress, "metrics-address", ":8081", "Address to serve Prometheus metrics and health checks on, empty disables them")
+	serverCmd.PersistentFlags().StringVar(&adminAddress, "admin-address", "localhost:8082", "Address to serve the admin API on, empty disables it")
+	serverCmd.PersistentFlags().StringVar(&adminToken, "admin-token", "", "Bearer token required by the admin API")
+	serverCmd.PersistentFlags().StringVar(&drainTimeout, "drain-timeout", "30s", "How long running requests may take to finish on shutdown")
+	serverCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "Minimum level of log messages: debug, info, warn or error, can be changed through the admin API")
+	serverCmd.PersistentFlags().IntVar(&upstreamMaxConnsPerHost, "upstream-max-conns-per-host", 0, "Maximum connections to the upstream, 0 means no limit")
+	serverCmd.PersistentFlags().IntVar(&upstreamMaxIdleConnsPerHost, "upstream-max-idle-conns-per-host", 32, "Idle connections to the upstream kept open for reuse")
+	serverCmd.PersistentFlags().StringVar(&upstreamIdleConnTimeout, "upstream-idle-conn-timeout", "90s", "How long idle connections to the upstream are kept open")
+	serverCmd.PersistentFlags().StringVar(&upstreamDialTimeout, "upstream-dial-timeout", "10s", "Timeout for connecting to the upstream")
+	serverCmd.PersistentFlags().StringVar(&upstreamTLSHandshakeTimeout, "upstream-tls-handshake-timeout", "10s", "Timeout for the TLS handshake with the upstream")
+	serverCmd.PersistentFlags().StringVar(&upstreamResponseHeaderTimeout, "upstream-response-header-timeout", "30s", "How long to wait for the upstream's response headers")
+	serverCmd.PersistentFlags().BoolVar(&upstreamHTTP2, "upstream-http2", true, "Use HTTP/2 with upstreams that support it")
+	serverCmd.PersistentFlags().BoolVar(&upstreamRanges, "upstream-ranges", true, "Fetch blocks with Range requests, disable for upstreams that don't support them")
+	serverCmd.PersistentFlags().BoolVar(&upstreamTLSVerify, "upstream-tls-verify", false, "Verify the upstream's certificate")
+	serverCmd.PersistentFlags().StringVar(&upstreamCAFile, "upstream-ca-file", "", "PEM bundle of CAs to verify the upstream's certificate against, turns on verification")
+	serverCmd.PersistentFlags().StringVar(&upstreamCertFile, "upstream-cert-file", "", "Client certificate presented to the upstream")
+	serverCmd.PersistentFlags().StringVar(&upstreamKeyFile, "upstream-key-file", "", "Key of the client certificate presented to the upstream")
+	serverCmd.PersistentFlags().StringVar(&accessLog, "access-log", "json", "Format of the access log written to stdout: json, combined or off")
 
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.: